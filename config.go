@@ -4,32 +4,142 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"net"
 	"os"
+	"strings"
 )
 
 type ConfigurationFile struct {
-	BannerHost          string `json:"banner_host"`
-	BannerName          string `json:"banner_name"`
-	CertFile            string `json:"cert_file"`
-	ConnectionTimeLimit int    `json:"connection_time_limit"`
-	IsTLS               bool   `json:"is_tls"`
-	KeyFile             string `json:"key_file"`
-	ListenHost          string `json:"listen_host"`
-	ListenPort          int    `json:"listen_port"`
-	LogConnection       string `json:"log_connection"`
-	ReadTimeout         int    `json:"read_timeout"`
+	AuthPolicy          string                            `json:"auth"`
+	BannerHost          string                            `json:"banner_host"`
+	BannerName          string                            `json:"banner_name"`
+	CertFile            string                            `json:"cert_file"`
+	Certificates        []CertificateConfiguration        `json:"certificates"`
+	ConnectionTimeLimit int                               `json:"connection_time_limit"`
+	IsLMTP              bool                              `json:"lmtp"`
+	IsTLS               bool                              `json:"is_tls"`
+	KeyFile             string                            `json:"key_file"`
+	Listen              string                            `json:"listen"`
+	ListenHost          string                            `json:"listen_host"`
+	ListenPort          int                               `json:"listen_port"`
+	Listeners           []ListenerConfigurationFile       `json:"listeners"`
+	LMTPReplies         map[string]LMTPReplyConfiguration `json:"lmtp_replies"`
+	LogConnection       string                            `json:"log_connection"`
+	MaxConnections      int                               `json:"max_connections"`
+	MaxConnectionsPerIP int                               `json:"max_connections_per_ip"`
+	MaxErrors           int                               `json:"max_errors"`
+	MaxLineLength       int                               `json:"max_line_length"`
+	MaxMessageSize      int64                             `json:"max_message_size"`
+	MaxRecipients       int                               `json:"max_recipients"`
+	MetricsListen       string                            `json:"metrics_listen"`
+	ProxyProtocol       bool                              `json:"proxy_protocol"`
+	ProxyTrusted        []string                          `json:"proxy_trusted"`
+	RateLimits          map[string]RateLimits             `json:"rate_limits"`
+	ReadTimeout         int                               `json:"read_timeout"`
+	TLSCacheDirectory   string                            `json:"tls_cache_dir"`
+	TLSCertificate      string                            `json:"tls_certificate"`
+	TLSCiphers          []string                          `json:"tls_ciphers"`
+	TLSClientAuth       string                            `json:"tls_client_auth"`
+	TLSClientCA         string                            `json:"tls_client_ca"`
+	TLSCurves           []string                          `json:"tls_curves"`
+	TLSMaxVersion       string                            `json:"tls_max_version"`
+	TLSMinVersion       string                            `json:"tls_min_version"`
+	TLSNames            []string                          `json:"tls_sans"`
+	TraceHeaders        *bool                             `json:"trace_headers"`
+	XClientTrusted      []string                          `json:"xclient_trusted"`
 }
 
+// ListenerConfigurationFile describes a single listener. Any setting left empty falls back
+// to the value set at the top level of the configuration file.
+type ListenerConfigurationFile struct {
+	AuthPolicy          string   `json:"auth"`
+	BannerHost          string   `json:"banner_host"`
+	BannerName          string   `json:"banner_name"`
+	ConnectionTimeLimit int      `json:"connection_time_limit"`
+	Listen              string   `json:"listen"`
+	ListenHost          string   `json:"listen_host"`
+	ListenPort          int      `json:"listen_port"`
+	MaxErrors           int      `json:"max_errors"`
+	MaxLineLength       int      `json:"max_line_length"`
+	MaxMessageSize      int64    `json:"max_message_size"`
+	MaxRecipients       int      `json:"max_recipients"`
+	Name                string   `json:"name"`
+	Protocol            string   `json:"protocol"`
+	ProxyProtocol       bool     `json:"proxy_protocol"`
+	ProxyTrusted        []string `json:"proxy_trusted"`
+	ReadTimeout         int      `json:"read_timeout"`
+	TLSCiphers          []string `json:"tls_ciphers"`
+	TLSClientAuth       string   `json:"tls_client_auth"`
+	TLSClientCA         string   `json:"tls_client_ca"`
+	TLSCurves           []string `json:"tls_curves"`
+	TLSMaxVersion       string   `json:"tls_max_version"`
+	TLSMinVersion       string   `json:"tls_min_version"`
+	TLSMode             string   `json:"tls"`
+	TraceHeaders        *bool    `json:"trace_headers"`
+	XClientTrusted      []string `json:"xclient_trusted"`
+}
+
+// CertificateConfiguration is a certificate and key pair. When several are configured the
+// one matching the server name requested by the client is used.
+type CertificateConfiguration struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+}
+
+type LMTPReplyConfiguration struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Status  string `json:"status"`
+}
+
+type AuthPolicy int
+
+const (
+	AuthPolicyOptional AuthPolicy = 0
+	AuthPolicyRequired AuthPolicy = 1
+	AuthPolicyDisabled AuthPolicy = 2
+)
+
+type TLSMode int
+
+const (
+	TLSModeNone     TLSMode = 0
+	TLSModeSTARTTLS TLSMode = 1
+	TLSModeImplicit TLSMode = 2
+)
+
 type Configuration struct {
+	Listeners           []*ListenerConfiguration
+	LogConnection       string
+	MaxConnections      int
+	MaxConnectionsPerIP int
+	MetricsListen       string
+	RateLimits          map[string]RateLimits
+}
+
+type ListenerConfiguration struct {
+	AuthPolicy          AuthPolicy
 	BannerHost          string
 	BannerName          string
+	Certificates        *CertificateStore
 	ConnectionTimeLimit int
-	IsTLS               bool
-	ListenHost          string
-	ListenPort          int
-	LogConnection       string
+	IsLMTP              bool
+	IsProxyProtocol     bool
+	ListenAddress       string
+	ListenNetwork       string
+	LMTPReplies         map[string]*SMTPResponse
+	MaxErrors           int
+	MaxLineLength       int
+	MaxMessageSize      int64
+	MaxRecipients       int
+	Name                string
+	ProxyTrusted        []*net.IPNet
 	ReadTimeout         int
 	TLSConfig           *tls.Config
+	TLSMode             TLSMode
+	TLSPolicy           TLSPolicy
+	TraceHeaders        bool
+	XClientTrusted      []*net.IPNet
 }
 
 func LoadConfiguration(file string) (config *Configuration, err error) {
@@ -47,51 +157,382 @@ func LoadConfiguration(file string) (config *Configuration, err error) {
 		return nil, err
 	}
 
-	tlsConfig, err := loadTLSConfig(configuration.CertFile, configuration.KeyFile)
+	if configuration.MaxConnections < 0 || configuration.MaxConnectionsPerIP < 0 {
+		return nil, fmt.Errorf("max_connections and max_connections_per_ip cannot be negative")
+	}
+
+	err = checkRateLimits(configuration.RateLimits)
 	if err != nil {
 		return nil, err
 	}
 
+	files := certificateFiles(configuration)
+	switch strings.ToLower(configuration.TLSCertificate) {
+	case "":
+	case "auto":
+		if len(files) == 0 {
+			file, err := ensureSelfSignedCertificate(configuration.TLSCacheDirectory, selfSignedNames(configuration))
+			if err != nil {
+				return nil, fmt.Errorf("failed to generate self-signed certificate, %w", err)
+			}
+			files = append(files, file)
+		}
+	default:
+		return nil, fmt.Errorf("unknown tls_certificate setting %s, expected auto", configuration.TLSCertificate)
+	}
+
+	certificates, err := loadCertificates(files)
+	if err != nil {
+		return nil, err
+	}
+
+	lmtpReplies, err := loadLMTPReplies(configuration.LMTPReplies)
+	if err != nil {
+		return nil, err
+	}
+
+	listenerFiles := configuration.Listeners
+	if len(listenerFiles) == 0 {
+		listenerFiles = []ListenerConfigurationFile{{}}
+	}
+
+	// Listeners are matched by name when reloading and handing off, so names must be unique.
+	names := make(map[string]bool, len(listenerFiles))
+	listeners := make([]*ListenerConfiguration, 0, len(listenerFiles))
+	for _, listenerFile := range listenerFiles {
+		listener, err := loadListenerConfiguration(configuration, listenerFile)
+		if err != nil {
+			return nil, err
+		}
+
+		if listener.Name == "" {
+			return nil, fmt.Errorf("listener on %s has an empty name", listener.ListenAddress)
+		}
+		if names[listener.Name] {
+			return nil, fmt.Errorf("listener name %s is used more than once", listener.Name)
+		}
+		names[listener.Name] = true
+
+		if listener.TLSMode != TLSModeNone {
+			if certificates == nil {
+				return nil, fmt.Errorf("listener %s requires cert_file and key_file", listener.Name)
+			}
+
+			listener.TLSPolicy = loadTLSPolicy(configuration, listenerFile)
+			listener.TLSConfig, err = loadTLSConfig(certificates, listener.TLSPolicy)
+			if err != nil {
+				return nil, fmt.Errorf("listener %s, %w", listener.Name, err)
+			}
+			listener.Certificates = certificates
+		}
+		listener.LMTPReplies = lmtpReplies
+
+		listeners = append(listeners, listener)
+	}
+
 	return &Configuration{
-		BannerHost:          configuration.BannerHost,
-		BannerName:          configuration.BannerName,
-		ConnectionTimeLimit: configuration.ConnectionTimeLimit,
-		IsTLS:               configuration.IsTLS,
-		ListenHost:          configuration.ListenHost,
-		ListenPort:          configuration.ListenPort,
+		Listeners:           listeners,
 		LogConnection:       configuration.LogConnection,
-		ReadTimeout:         configuration.ReadTimeout,
-		TLSConfig:           tlsConfig,
+		MaxConnections:      configuration.MaxConnections,
+		MaxConnectionsPerIP: configuration.MaxConnectionsPerIP,
+		MetricsListen:       configuration.MetricsListen,
+		RateLimits:          configuration.RateLimits,
 	}, nil
 }
 
-func loadTLSConfig(certFile string, keyFile string) (*tls.Config, error) {
-	if certFile == "" || keyFile == "" {
-		return nil, nil
+// MaxConnectionTimeLimit returns the longest time any listener allows a connection to live.
+func (n *Configuration) MaxConnectionTimeLimit() int {
+	limit := 0
+	for _, listener := range n.Listeners {
+		if listener.ConnectionTimeLimit > limit {
+			limit = listener.ConnectionTimeLimit
+		}
+	}
+	return limit
+}
+
+func loadListenerConfiguration(
+	defaults ConfigurationFile,
+	listener ListenerConfigurationFile,
+) (*ListenerConfiguration, error) {
+	config := &ListenerConfiguration{
+		BannerHost:          firstString(listener.BannerHost, defaults.BannerHost),
+		BannerName:          firstString(listener.BannerName, defaults.BannerName),
+		ConnectionTimeLimit: firstInt(listener.ConnectionTimeLimit, defaults.ConnectionTimeLimit),
+		MaxErrors:           firstInt(listener.MaxErrors, defaults.MaxErrors),
+		MaxLineLength:       firstInt(listener.MaxLineLength, defaults.MaxLineLength),
+		MaxMessageSize:      listener.MaxMessageSize,
+		MaxRecipients:       firstInt(listener.MaxRecipients, defaults.MaxRecipients),
+		ReadTimeout:         firstInt(listener.ReadTimeout, defaults.ReadTimeout),
+	}
+
+	if config.MaxMessageSize == 0 {
+		config.MaxMessageSize = defaults.MaxMessageSize
+	}
+
+	listen := listener.Listen
+	if listen == "" && listener.ListenHost == "" && listener.ListenPort == 0 {
+		listen = defaults.Listen
+	}
+	if listen == "" {
+		listen = fmt.Sprintf(
+			"%s:%d",
+			firstString(listener.ListenHost, defaults.ListenHost),
+			firstInt(listener.ListenPort, defaults.ListenPort),
+		)
+	}
+
+	network, address, err := parseListenAddress(listen)
+	if err != nil {
+		return nil, err
+	}
+	config.ListenNetwork = network
+	config.ListenAddress = address
+
+	config.Name = listener.Name
+	if config.Name == "" {
+		config.Name = address
+		if network == "unix" {
+			config.Name = listen
+		}
+	}
+
+	authPolicy, err := parseAuthPolicy(firstString(listener.AuthPolicy, defaults.AuthPolicy))
+	if err != nil {
+		return nil, fmt.Errorf("listener %s, %w", config.Name, err)
+	}
+	config.AuthPolicy = authPolicy
+
+	config.IsProxyProtocol = listener.ProxyProtocol || defaults.ProxyProtocol
+	if config.IsProxyProtocol {
+		trusted := listener.ProxyTrusted
+		if len(trusted) == 0 {
+			trusted = defaults.ProxyTrusted
+		}
+
+		config.ProxyTrusted, err = parseNetworks(trusted)
+		if err != nil {
+			return nil, fmt.Errorf("listener %s, %w", config.Name, err)
+		}
+		if len(config.ProxyTrusted) == 0 {
+			return nil, fmt.Errorf("listener %s, proxy_protocol requires proxy_trusted", config.Name)
+		}
+	}
+
+	// Trace headers are only added when turned on, so messages are stored exactly as they
+	// were received unless asked otherwise.
+	if listener.TraceHeaders != nil {
+		config.TraceHeaders = *listener.TraceHeaders
+	} else if defaults.TraceHeaders != nil {
+		config.TraceHeaders = *defaults.TraceHeaders
 	}
 
-	_, certErr := os.Stat(certFile)
-	_, keyErr := os.Stat(keyFile)
-	if certErr != nil && keyErr != nil {
-		if os.IsNotExist(certErr) && os.IsNotExist(keyErr) {
-			return nil, fmt.Errorf("certificate and key file not found")
+	xclientTrusted := listener.XClientTrusted
+	if len(xclientTrusted) == 0 {
+		xclientTrusted = defaults.XClientTrusted
+	}
+
+	config.XClientTrusted, err = parseNetworks(xclientTrusted)
+	if err != nil {
+		return nil, fmt.Errorf("listener %s, %w", config.Name, err)
+	}
+
+	switch strings.ToLower(listener.Protocol) {
+	case "":
+		config.IsLMTP = defaults.IsLMTP
+	case "smtp":
+		config.IsLMTP = false
+	case "lmtp":
+		config.IsLMTP = true
+	default:
+		return nil, fmt.Errorf("listener %s, unknown protocol %s", config.Name, listener.Protocol)
+	}
+
+	tlsMode := listener.TLSMode
+	if tlsMode == "" {
+		tlsMode = "none"
+		if defaults.IsTLS {
+			tlsMode = "implicit"
+		} else if len(certificateFiles(defaults)) > 0 || strings.EqualFold(defaults.TLSCertificate, "auto") {
+			tlsMode = "starttls"
 		}
-		if os.IsNotExist(certErr) {
-			return nil, fmt.Errorf("certificate file not found")
+	}
+
+	switch strings.ToLower(tlsMode) {
+	case "none":
+		config.TLSMode = TLSModeNone
+	case "starttls":
+		config.TLSMode = TLSModeSTARTTLS
+	case "implicit":
+		config.TLSMode = TLSModeImplicit
+	default:
+		return nil, fmt.Errorf("listener %s, unknown tls mode %s", config.Name, listener.TLSMode)
+	}
+
+	return config, nil
+}
+
+// parseListenAddress splits a listen address into its network and address, accepting
+// unix:///path/to/socket, tcp://host:port or a bare host:port.
+func parseListenAddress(listen string) (string, string, error) {
+	if strings.HasPrefix(listen, "unix://") {
+		path := strings.TrimPrefix(listen, "unix://")
+		if path == "" {
+			return "", "", fmt.Errorf("invalid listen address %s, expected unix:///path/to/socket", listen)
 		}
-		if os.IsNotExist(keyErr) {
-			return nil, fmt.Errorf("key file not found")
+		return "unix", path, nil
+	}
+
+	address := strings.TrimPrefix(listen, "tcp://")
+	if strings.Contains(address, "://") {
+		return "", "", fmt.Errorf("invalid listen address %s, expected unix:// or tcp://", listen)
+	}
+
+	return "tcp", address, nil
+}
+
+// parseNetworks parses a list of CIDR networks, treating a bare IP address as a network
+// containing only that address.
+func parseNetworks(values []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(values))
+
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid network %s", value)
+			}
+
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
 		}
 
-		return nil, certErr
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %s", value)
+		}
+		networks = append(networks, network)
 	}
 
-	cer, err := tls.LoadX509KeyPair(certFile, keyFile)
+	return networks, nil
+}
+
+func parseAuthPolicy(policy string) (AuthPolicy, error) {
+	switch strings.ToLower(policy) {
+	case "", "optional":
+		return AuthPolicyOptional, nil
+	case "required":
+		return AuthPolicyRequired, nil
+	case "disabled":
+		return AuthPolicyDisabled, nil
+	}
+
+	return AuthPolicyOptional, fmt.Errorf("unknown auth policy %s", policy)
+}
+
+func checkRateLimits(rateLimits map[string]RateLimits) error {
+	for scope, limits := range rateLimits {
+		if !containsString(rateLimitScopes, scope) {
+			return fmt.Errorf("unknown rate_limits scope %s, expected %s", scope, strings.Join(rateLimitScopes, ", "))
+		}
+
+		if limits.MessagesPerMinute < 0 || limits.RecipientsPerHour < 0 || limits.RecipientsPerMessage < 0 {
+			return fmt.Errorf("rate_limits for %s cannot be negative", scope)
+		}
+	}
+
+	return nil
+}
+
+func firstString(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+func firstInt(values ...int) int {
+	for _, value := range values {
+		if value != 0 {
+			return value
+		}
+	}
+	return 0
+}
+
+func loadLMTPReplies(replies map[string]LMTPReplyConfiguration) (map[string]*SMTPResponse, error) {
+	responses := map[string]*SMTPResponse{}
+
+	for address, reply := range replies {
+		if reply.Code < 200 || reply.Code > 599 {
+			return nil, fmt.Errorf("invalid LMTP reply code %d for %s", reply.Code, address)
+		}
+
+		status := EnhancedStatusCode{}
+		if reply.Status != "" {
+			parsed, err := ParseEnhancedStatusCode(reply.Status)
+			if err != nil {
+				return nil, fmt.Errorf("invalid LMTP reply for %s, %w", address, err)
+			}
+			status = parsed
+		}
+
+		responses[strings.ToLower(address)] = &SMTPResponse{
+			code:    reply.Code,
+			status:  status,
+			message: reply.Message,
+		}
+	}
+
+	return responses, nil
+}
+
+// certificateFiles returns the certificates listed in the configuration file, including
+// the pair set with the top level cert_file and key_file.
+func certificateFiles(configuration ConfigurationFile) []CertificateConfiguration {
+	files := make([]CertificateConfiguration, 0, len(configuration.Certificates)+1)
+
+	if configuration.CertFile != "" && configuration.KeyFile != "" {
+		files = append(files, CertificateConfiguration{
+			CertFile: configuration.CertFile,
+			KeyFile:  configuration.KeyFile,
+		})
+	}
+
+	for _, file := range configuration.Certificates {
+		if file.CertFile != "" && file.KeyFile != "" {
+			files = append(files, file)
+		}
+	}
+
+	return files
+}
+
+func loadCertificates(files []CertificateConfiguration) (*CertificateStore, error) {
+	if len(files) == 0 {
+		return nil, nil
+	}
+
+	return LoadCertificateStore(files)
+}
+
+func loadTLSConfig(certificates *CertificateStore, policy TLSPolicy) (*tls.Config, error) {
+	config := &tls.Config{
+		GetCertificate: certificates.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+
+	err := policy.apply(config)
 	if err != nil {
 		return nil, err
 	}
 
-	return &tls.Config{ //nolint:gosec
-		Certificates: []tls.Certificate{cer},
-	}, nil
+	return config, nil
 }
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// Reload applies a freshly loaded configuration to the running server. Only settings that
+// can change without rebinding sockets or reconnecting to the database are accepted, and
+// they apply to connections accepted after the reload; existing sessions keep the settings
+// they started with.
+func (n *SMTPServer) Reload(config *Configuration) error {
+	err := checkReloadable(n.config, config)
+	if err != nil {
+		return err
+	}
+
+	changes := configurationChanges(n.config, config)
+	n.connections.SetLimits(config.MaxConnections, config.MaxConnectionsPerIP)
+	n.rateLimiter.SetLimits(config.RateLimits)
+
+	for _, listener := range n.listeners {
+		next := findListenerConfiguration(config, listener.name)
+
+		for _, change := range listenerChanges(listener.snapshotConfig(), next) {
+			changes = append(changes, fmt.Sprintf("listener %s %s", listener.name, change))
+		}
+
+		listener.setConfig(next, createListenerContext(n.context, next))
+	}
+
+	n.config = config
+
+	if len(changes) == 0 {
+		log.Printf("Reloaded configuration, nothing changed")
+		return nil
+	}
+
+	for _, change := range changes {
+		log.Printf("Reloaded configuration, %s", change)
+	}
+
+	return nil
+}
+
+// checkReloadable returns an error describing the first change that needs a restart.
+func checkReloadable(current *Configuration, next *Configuration) error {
+	if current.LogConnection != next.LogConnection {
+		return fmt.Errorf("log_connection cannot change without a restart")
+	}
+
+	if current.MetricsListen != next.MetricsListen {
+		return fmt.Errorf("metrics_listen cannot change without a restart")
+	}
+
+	if len(current.Listeners) != len(next.Listeners) {
+		return fmt.Errorf("listeners cannot be added or removed without a restart")
+	}
+
+	for _, listener := range current.Listeners {
+		nextListener := findListenerConfiguration(next, listener.Name)
+		if nextListener == nil {
+			return fmt.Errorf("listener %s cannot be removed or renamed without a restart", listener.Name)
+		}
+
+		if listener.ListenNetwork != nextListener.ListenNetwork ||
+			listener.ListenAddress != nextListener.ListenAddress {
+			return fmt.Errorf("listener %s cannot change its address without a restart", listener.Name)
+		}
+
+		if listener.IsLMTP != nextListener.IsLMTP {
+			return fmt.Errorf("listener %s cannot change its protocol without a restart", listener.Name)
+		}
+
+		if listener.TLSMode != nextListener.TLSMode {
+			return fmt.Errorf("listener %s cannot change its tls mode without a restart", listener.Name)
+		}
+	}
+
+	return nil
+}
+
+func findListenerConfiguration(config *Configuration, name string) *ListenerConfiguration {
+	for _, listener := range config.Listeners {
+		if listener.Name == name {
+			return listener
+		}
+	}
+	return nil
+}
+
+// configurationChanges describes each reloadable server wide setting that differs between
+// two configurations.
+func configurationChanges(current *Configuration, next *Configuration) []string {
+	var changes []string
+	changes = appendChange(changes, "max_connections", current.MaxConnections, next.MaxConnections)
+	changes = appendChange(changes, "max_connections_per_ip", current.MaxConnectionsPerIP, next.MaxConnectionsPerIP)
+	changes = appendChange(changes, "rate_limits", current.RateLimits, next.RateLimits)
+
+	return changes
+}
+
+// listenerChanges describes each reloadable setting that differs between two listener
+// configurations, using the names from the configuration file.
+func listenerChanges(current *ListenerConfiguration, next *ListenerConfiguration) []string {
+	var changes []string
+
+	compare := func(name string, currentValue interface{}, nextValue interface{}) {
+		changes = appendChange(changes, name, currentValue, nextValue)
+	}
+
+	compare("auth", formatAuthPolicy(current.AuthPolicy), formatAuthPolicy(next.AuthPolicy))
+	compare("banner_host", current.BannerHost, next.BannerHost)
+	compare("banner_name", current.BannerName, next.BannerName)
+	compare("certificates", current.Certificates, next.Certificates)
+	compare("connection_time_limit", current.ConnectionTimeLimit, next.ConnectionTimeLimit)
+	compare("lmtp_replies", formatLMTPReplies(current.LMTPReplies), formatLMTPReplies(next.LMTPReplies))
+	compare("max_errors", current.MaxErrors, next.MaxErrors)
+	compare("max_line_length", current.MaxLineLength, next.MaxLineLength)
+	compare("max_message_size", current.MaxMessageSize, next.MaxMessageSize)
+	compare("max_recipients", current.MaxRecipients, next.MaxRecipients)
+	compare("proxy_protocol", current.IsProxyProtocol, next.IsProxyProtocol)
+	compare("proxy_trusted", current.ProxyTrusted, next.ProxyTrusted)
+	compare("read_timeout", current.ReadTimeout, next.ReadTimeout)
+	compare("tls_ciphers", current.TLSPolicy.Ciphers, next.TLSPolicy.Ciphers)
+	compare("tls_client_auth", current.TLSPolicy.ClientAuth, next.TLSPolicy.ClientAuth)
+	compare("tls_client_ca", current.TLSPolicy.ClientCA, next.TLSPolicy.ClientCA)
+	compare("tls_curves", current.TLSPolicy.Curves, next.TLSPolicy.Curves)
+	compare("tls_max_version", current.TLSPolicy.MaxVersion, next.TLSPolicy.MaxVersion)
+	compare("tls_min_version", current.TLSPolicy.MinVersion, next.TLSPolicy.MinVersion)
+	compare("trace_headers", current.TraceHeaders, next.TraceHeaders)
+	compare("xclient_trusted", current.XClientTrusted, next.XClientTrusted)
+
+	return changes
+}
+
+func appendChange(changes []string, name string, currentValue interface{}, nextValue interface{}) []string {
+	currentText := fmt.Sprintf("%v", currentValue)
+	nextText := fmt.Sprintf("%v", nextValue)
+	if currentText != nextText {
+		changes = append(changes, fmt.Sprintf("%s changed from %q to %q", name, currentText, nextText))
+	}
+
+	return changes
+}
+
+func formatAuthPolicy(policy AuthPolicy) string {
+	switch policy {
+	case AuthPolicyRequired:
+		return "required"
+	case AuthPolicyDisabled:
+		return "disabled"
+	}
+	return "optional"
+}
+
+func formatLMTPReplies(replies map[string]*SMTPResponse) string {
+	formatted := make([]string, 0, len(replies))
+	for address, reply := range replies {
+		formatted = append(formatted, fmt.Sprintf("%s=%d %s %s", address, reply.code, reply.status, reply.message))
+	}
+	sort.Strings(formatted)
+
+	return strings.Join(formatted, ", ")
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfigurationTLSCertificateAuto(t *testing.T) {
+	directory := t.TempDir()
+	file := filepath.Join(directory, "config.json")
+
+	err := os.WriteFile(file, []byte(`{
+		"banner_host": "mx.example.com",
+		"tls_certificate": "auto",
+		"tls_cache_dir": "`+filepath.ToSlash(directory)+`",
+		"listeners": [
+			{"name": "submission", "listen": "127.0.0.1:587"},
+			{"name": "smtps", "listen": "127.0.0.1:465", "tls": "implicit"},
+			{"name": "plain", "listen": "127.0.0.1:25", "tls": "none"}
+		]
+	}`), 0o600)
+	if err != nil {
+		t.Fatalf("Failed to write %s, %s", file, err)
+	}
+
+	config, err := LoadConfiguration(file)
+	if err != nil {
+		t.Fatalf("Failed to load configuration, %s", err)
+	}
+
+	expected := []TLSMode{TLSModeSTARTTLS, TLSModeImplicit, TLSModeNone}
+	for i, listener := range config.Listeners {
+		if listener.TLSMode != expected[i] {
+			t.Errorf("Expected listener %s to use tls mode %d, got %d", listener.Name, expected[i], listener.TLSMode)
+		}
+		if listener.TLSMode != TLSModeNone && listener.TLSConfig == nil {
+			t.Errorf("Expected listener %s to have a certificate", listener.Name)
+		}
+	}
+}
+
+func TestLoadConfigurationTraceHeaders(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.json")
+
+	err := os.WriteFile(file, []byte(`{
+		"listeners": [
+			{"name": "default", "listen": "127.0.0.1:25"},
+			{"name": "traced", "listen": "127.0.0.1:26", "trace_headers": true}
+		]
+	}`), 0o600)
+	if err != nil {
+		t.Fatalf("Failed to write %s, %s", file, err)
+	}
+
+	config, err := LoadConfiguration(file)
+	if err != nil {
+		t.Fatalf("Failed to load configuration, %s", err)
+	}
+
+	if config.Listeners[0].TraceHeaders {
+		t.Errorf("Expected trace headers to be off by default")
+	}
+	if !config.Listeners[1].TraceHeaders {
+		t.Errorf("Expected trace headers to be on when enabled for the listener")
+	}
+}
+
+func TestLoadConfigurationListenerNames(t *testing.T) {
+	tests := []struct {
+		name      string
+		listeners string
+		valid     bool
+	}{
+		{"unique names", `{"name": "one", "listen": "127.0.0.1:25"}, {"name": "two", "listen": "127.0.0.1:26"}`, true},
+		{"default names", `{"listen": "127.0.0.1:25"}, {"listen": "127.0.0.1:26"}`, true},
+		{"duplicate names", `{"name": "one", "listen": "127.0.0.1:25"}, {"name": "one", "listen": "127.0.0.1:26"}`, false},
+		{"name matching a default", `{"listen": "127.0.0.1:25"}, {"name": "127.0.0.1:25", "listen": "127.0.0.1:26"}`, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "config.json")
+
+			err := os.WriteFile(file, []byte(`{"listeners": [`+test.listeners+`]}`), 0o600)
+			if err != nil {
+				t.Fatalf("Failed to write %s, %s", file, err)
+			}
+
+			_, err = LoadConfiguration(file)
+			if test.valid && err != nil {
+				t.Errorf("Expected configuration to load, got %s", err)
+			}
+			if !test.valid && err == nil {
+				t.Errorf("Expected configuration to be rejected")
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// rejectionLogInterval is the least time between rejected connections being logged, so a
+// flood of connections over the limits cannot flood the log and database as well.
+const rejectionLogInterval = 10 * time.Second
+
+var (
+	errTooManyConnections        = errors.New("too many connections")
+	errTooManyAddressConnections = errors.New("too many connections from address")
+)
+
+// ConnectionRegistry tracks the open connections by their ULID.
+//
+// It also counts the connections holding a slot, in total and per remote address, so the
+// configured connection limits apply from the moment a connection is accepted.
+type ConnectionRegistry struct {
+	addresses                map[string]int
+	connections              map[string]*SMTPConnection
+	lastRejectionLogged      time.Time
+	lock                     sync.Mutex
+	maxConnections           int
+	maxConnectionsPerAddress int
+	reserved                 int
+	unloggedRejections       int
+}
+
+func CreateConnectionRegistry(maxConnections int, maxConnectionsPerAddress int) *ConnectionRegistry {
+	return &ConnectionRegistry{
+		addresses:                map[string]int{},
+		connections:              map[string]*SMTPConnection{},
+		maxConnections:           maxConnections,
+		maxConnectionsPerAddress: maxConnectionsPerAddress,
+	}
+}
+
+func (n *ConnectionRegistry) Add(connection *SMTPConnection) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.connections[connection.connectionULID] = connection
+}
+
+func (n *ConnectionRegistry) Remove(connection *SMTPConnection) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	delete(n.connections, connection.connectionULID)
+}
+
+// Each calls the callback for every registered connection. The callback runs without
+// the lock held, so it may close connections or otherwise use the registry.
+func (n *ConnectionRegistry) Each(callback func(connection *SMTPConnection)) {
+	n.lock.Lock()
+	connections := make([]*SMTPConnection, 0, len(n.connections))
+	for _, connection := range n.connections {
+		connections = append(connections, connection)
+	}
+	n.lock.Unlock()
+
+	for _, connection := range connections {
+		callback(connection)
+	}
+}
+
+// SetLimits changes the connection limits, zero meaning unlimited. Connections already
+// holding a slot are not affected.
+func (n *ConnectionRegistry) SetLimits(maxConnections int, maxConnectionsPerAddress int) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.maxConnections = maxConnections
+	n.maxConnectionsPerAddress = maxConnectionsPerAddress
+}
+
+// Reserve takes a connection slot for the remote address, returning an error when either
+// limit has been reached. Connections without an address, such as those on a Unix socket,
+// only count towards the total. Each successful Reserve must be followed by a Release.
+func (n *ConnectionRegistry) Reserve(address string) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.maxConnections > 0 && n.reserved >= n.maxConnections {
+		return errTooManyConnections
+	}
+
+	if address != "" && n.maxConnectionsPerAddress > 0 && n.addresses[address] >= n.maxConnectionsPerAddress {
+		return errTooManyAddressConnections
+	}
+
+	n.reserved++
+	if address != "" {
+		n.addresses[address]++
+	}
+
+	return nil
+}
+
+func (n *ConnectionRegistry) Release(address string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.reserved--
+	if address == "" {
+		return
+	}
+
+	n.addresses[address]--
+	if n.addresses[address] <= 0 {
+		delete(n.addresses, address)
+	}
+}
+
+// LogRejection returns whether a connection rejected now should be logged, and how many
+// rejections were not logged since the last one that was.
+func (n *ConnectionRegistry) LogRejection(now time.Time) (bool, int) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if now.Sub(n.lastRejectionLogged) < rejectionLogInterval {
+		n.unloggedRejections++
+		return false, 0
+	}
+
+	unlogged := n.unloggedRejections
+	n.lastRejectionLogged = now
+	n.unloggedRejections = 0
+
+	return true, unlogged
+}
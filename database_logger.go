@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/oklog/ulid/v2"
@@ -17,6 +18,25 @@ type DatabaseLogger struct {
 	pool    *sql.DB
 }
 
+// ConnectionRecord describes where a connection came from. TCP connections record the
+// remote address and port, Unix socket connections record the peer credentials instead where
+// the platform provides them.
+type ConnectionRecord struct {
+	HeloName        string
+	IsHeloVerified  bool
+	ListenerName    string
+	Login           string
+	PeerCredentials *PeerCredentials
+	ProxyAddress    string
+	ProxyPort       int
+	RejectCount     int
+	RejectReason    string
+	RemoteAddress   string
+	RemotePort      int
+	ReverseName     string
+	TLS             *TLSDetails
+}
+
 type LogDirection int
 
 const (
@@ -60,26 +80,66 @@ func CreateDatabaseLogger(ctx context.Context, dataSourceName string) (*Database
 	}, nil
 }
 
-func (logger *DatabaseLogger) LogConnection(
-	remoteAddress string,
-	remotePort int,
-) (int64, error) {
+func (record ConnectionRecord) String() string {
+	if record.PeerCredentials != nil {
+		return fmt.Sprintf(
+			"unix:pid=%d,uid=%d,gid=%d",
+			record.PeerCredentials.PID,
+			record.PeerCredentials.UID,
+			record.PeerCredentials.GID,
+		)
+	}
+
+	if record.RemoteAddress == "" {
+		return "unix"
+	}
+
+	return fmt.Sprintf("%s:%d", record.RemoteAddress, record.RemotePort)
+}
+
+func (logger *DatabaseLogger) LogConnection(connectionULID string, record ConnectionRecord) (int64, error) {
 	_, cancel := context.WithTimeout(logger.context, 5*time.Second)
 	defer cancel()
 
 	stmtInsert, err := logger.pool.Prepare(
-		"INSERT INTO connections (ulid, remote_address, remote_port, created_at, updated_at) " +
-			"values (?, ?, ?, NOW(), NOW())",
+		"INSERT INTO connections (ulid, listener, remote_address, remote_port, peer_pid, peer_uid, peer_gid," +
+			" proxy_address, proxy_port, tls_version, tls_cipher, tls_server_name, tls_alpn, tls_client_subject," +
+			" tls_client_fingerprint, reject_count, reject_reason, created_at, updated_at)" +
+			" values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NOW(), NOW())",
 	)
 	if err != nil {
 		return 0, err
 	}
 
-	result, err := stmtInsert.Exec(
-		strings.ToLower(ulid.Make().String()),
+	var peerPID, peerUID, peerGID sql.NullInt64
+	if record.PeerCredentials != nil {
+		peerPID = sql.NullInt64{Int64: int64(record.PeerCredentials.PID), Valid: true}
+		peerUID = sql.NullInt64{Int64: int64(record.PeerCredentials.UID), Valid: true}
+		peerGID = sql.NullInt64{Int64: int64(record.PeerCredentials.GID), Valid: true}
+	}
+
+	remoteAddress, remotePort := nullableAddress(record.RemoteAddress, record.RemotePort)
+	proxyAddress, proxyPort := nullableAddress(record.ProxyAddress, record.ProxyPort)
+
+	arguments := []interface{}{
+		connectionULID,
+		record.ListenerName,
 		remoteAddress,
 		remotePort,
+		peerPID,
+		peerUID,
+		peerGID,
+		proxyAddress,
+		proxyPort,
+	}
+	arguments = append(arguments, tlsColumns(record.TLS)...)
+	arguments = append(
+		arguments,
+		sql.NullInt64{Int64: int64(record.RejectCount), Valid: record.RejectCount > 0},
+		nullableString(record.RejectReason),
 	)
+
+	result, err := stmtInsert.Exec(arguments...)
 	if err != nil {
 		return 0, err
 	}
@@ -89,6 +149,47 @@ func (logger *DatabaseLogger) LogConnection(
 	return result.LastInsertId()
 }
 
+// UpdateConnection stores the parts of the connection record that can change during the
+// session, such as the client identity forwarded with XCLIENT.
+func (logger *DatabaseLogger) UpdateConnection(connectionID int64, record ConnectionRecord) error {
+	_, cancel := context.WithTimeout(logger.context, 5*time.Second)
+	defer cancel()
+
+	stmtUpdate, err := logger.pool.Prepare(
+		"UPDATE connections SET remote_address = ?, remote_port = ?, proxy_address = ?, proxy_port = ?," +
+			" helo_name = ?, helo_verified = ?, reverse_name = ?, login = ?, tls_version = ?, tls_cipher = ?, tls_server_name = ?, tls_alpn = ?," +
+			" tls_client_subject = ?, tls_client_fingerprint = ?, updated_at = NOW() WHERE id = ?",
+	)
+	if err != nil {
+		return err
+	}
+
+	remoteAddress, remotePort := nullableAddress(record.RemoteAddress, record.RemotePort)
+	proxyAddress, proxyPort := nullableAddress(record.ProxyAddress, record.ProxyPort)
+
+	arguments := []interface{}{
+		remoteAddress,
+		remotePort,
+		proxyAddress,
+		proxyPort,
+		nullableString(record.HeloName),
+		record.IsHeloVerified,
+		nullableString(record.ReverseName),
+		nullableString(record.Login),
+	}
+	arguments = append(arguments, tlsColumns(record.TLS)...)
+	arguments = append(arguments, connectionID)
+
+	_, err = stmtUpdate.Exec(arguments...)
+	if err != nil {
+		return err
+	}
+
+	_ = stmtUpdate.Close()
+
+	return nil
+}
+
 func (logger *DatabaseLogger) LogMessage(
 	connectionID int64,
 	direction LogDirection,
@@ -165,7 +266,7 @@ func (logger *DatabaseLogger) LogMail(
 	_, cancel := context.WithTimeout(logger.context, 5*time.Second)
 	defer cancel()
 
-	mailID, err := logger.createMail(connectionID, message.data)
+	mailID, err := logger.createMail(connectionID, message)
 	if err != nil {
 		return 0, err
 	}
@@ -175,17 +276,17 @@ func (logger *DatabaseLogger) LogMail(
 		return mailID, err
 	}
 
-	_, err = logger.createMailRecipient(mailID, fromRecipientID, RecipientFrom)
+	_, err = logger.createMailRecipient(mailID, fromRecipientID, RecipientFrom, SMTPRecipient{})
 	if err != nil {
 		return mailID, err
 	}
 
 	for _, to := range message.to {
-		toRecipientID, err := logger.fetchOrCreateRecipient(to)
+		toRecipientID, err := logger.fetchOrCreateRecipient(to.address)
 		if err != nil {
 			return mailID, err
 		}
-		_, err = logger.createMailRecipient(mailID, toRecipientID, RecipientTo)
+		_, err = logger.createMailRecipient(mailID, toRecipientID, RecipientTo, to)
 		if err != nil {
 			return mailID, err
 		}
@@ -198,22 +299,32 @@ func (logger *DatabaseLogger) Close() error {
 	return logger.pool.Close()
 }
 
-func (logger *DatabaseLogger) createMail(connectionID int64, data string) (int64, error) {
+func (logger *DatabaseLogger) createMail(connectionID int64, message SMTPMessage) (int64, error) {
 	_, cancel := context.WithTimeout(logger.context, 5*time.Second)
 	defer cancel()
 
 	stmtInsert, err := logger.pool.Prepare(
-		"INSERT INTO mail (ulid, connection_id, data, created_at, updated_at)" +
-			" values (?, ?, ?, NOW(), NOW())",
+		"INSERT INTO mail (ulid, connection_id, data, has_bare_lf, has_long_line, dsn_ret, dsn_envid," +
+			" parameters, created_at, updated_at) values (?, ?, ?, ?, ?, ?, ?, ?, NOW(), NOW())",
 	)
 	if err != nil {
 		return 0, err
 	}
 
+	parameters, err := encodeParameters(message.parameters)
+	if err != nil {
+		return 0, err
+	}
+
 	result, err := stmtInsert.Exec(
 		strings.ToLower(ulid.Make().String()),
 		connectionID,
-		data,
+		message.data,
+		message.hasBareLF,
+		message.hasLongLine,
+		nullableString(message.dsnReturn),
+		nullableString(message.dsnEnvelopeID),
+		parameters,
 	)
 	if err != nil {
 		return 0, err
@@ -228,19 +339,32 @@ func (logger *DatabaseLogger) createMailRecipient(
 	mailID int64,
 	recipientID int64,
 	recipientType RecipientType,
+	recipient SMTPRecipient,
 ) (int64, error) {
 	_, cancel := context.WithTimeout(logger.context, 5*time.Second)
 	defer cancel()
 
 	stmtInsert, err := logger.pool.Prepare(
-		"INSERT INTO mail_recipient (mail_id, recipient_id, type, created_at, updated_at)" +
-			" values (?, ?, ?, NOW(), NOW())",
+		"INSERT INTO mail_recipient (mail_id, recipient_id, type, dsn_notify, dsn_orcpt, parameters," +
+			" created_at, updated_at) values (?, ?, ?, ?, ?, ?, NOW(), NOW())",
 	)
 	if err != nil {
 		return 0, err
 	}
 
-	result, err := stmtInsert.Exec(mailID, recipientID, recipientType)
+	parameters, err := encodeParameters(recipient.parameters)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := stmtInsert.Exec(
+		mailID,
+		recipientID,
+		recipientType,
+		nullableString(recipient.dsnNotify),
+		nullableString(recipient.dsnOriginalRecipient),
+		parameters,
+	)
 	if err != nil {
 		return 0, err
 	}
@@ -249,3 +373,45 @@ func (logger *DatabaseLogger) createMailRecipient(
 
 	return result.LastInsertId()
 }
+
+func nullableString(value string) sql.NullString {
+	return sql.NullString{String: value, Valid: len(value) > 0}
+}
+
+func nullableAddress(address string, port int) (sql.NullString, sql.NullInt64) {
+	if address == "" {
+		return sql.NullString{}, sql.NullInt64{}
+	}
+
+	return nullableString(address), sql.NullInt64{Int64: int64(port), Valid: port > 0}
+}
+
+// tlsColumns returns the values of the tls_* connection columns, all null when the
+// connection is not encrypted.
+func tlsColumns(details *TLSDetails) []interface{} {
+	if details == nil {
+		details = &TLSDetails{}
+	}
+
+	return []interface{}{
+		nullableString(details.Version),
+		nullableString(details.CipherSuite),
+		nullableString(details.ServerName),
+		nullableString(details.ALPN),
+		nullableString(details.ClientSubject),
+		nullableString(details.ClientFingerprint),
+	}
+}
+
+func encodeParameters(parameters map[string]string) (sql.NullString, error) {
+	if len(parameters) == 0 {
+		return sql.NullString{}, nil
+	}
+
+	encoded, err := json.Marshal(parameters)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+
+	return nullableString(string(encoded)), nil
+}
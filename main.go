@@ -6,11 +6,20 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "gen-cert" {
+		err := generateCertificateCommand(os.Args[2:])
+		if err != nil {
+			log.Fatalf("Failed to generate certificate %s", err)
+		}
+		return
+	}
+
 	configFile := flag.String("config", "", "Configuration file")
 	flag.Parse()
 
@@ -35,33 +44,120 @@ func main() {
 		log.Fatalf("Failed to start server %s", err)
 	}
 
-	defer stop()
-
-	defer func(logger *DatabaseLogger) {
-		err := logger.Close()
+	if config.MetricsListen != "" {
+		err = server.ServeMetrics(config.MetricsListen)
 		if err != nil {
-			log.Printf("Failed to close database connection %s", err)
+			log.Fatalf("Failed to serve metrics %s", err)
 		}
-	}(logger)
+	}
 
-	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	NotifyReady()
 
-	go func() {
-		<-signals
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
 
-		server.Stop()
+	if len(handOffSignals) > 0 {
+		signal.Notify(signals, handOffSignals...)
+	}
 
-		shutdownTimeout := config.ConnectionTimeLimit + 1
-		log.Printf("Waiting %d seconds for graceful shutdown", shutdownTimeout)
-		time.Sleep(time.Duration(shutdownTimeout) * time.Second)
+	drained := make(chan bool, 1)
 
-		log.Printf("Forcing connections closed")
-		server.CloseConnections()
+	go func() {
+		for {
+			received := <-signals
+			if received == syscall.SIGHUP {
+				reloaded, err := LoadConfiguration(*configFile)
+				if err != nil {
+					log.Printf("Failed to reload configuration, %s", err)
+					continue
+				}
+
+				err = server.Reload(reloaded)
+				if err != nil {
+					log.Printf("Rejected configuration reload, %s", err)
+					continue
+				}
+
+				config = reloaded
+				continue
+			}
+
+			if !isHandOffSignal(received) {
+				break
+			}
+
+			err := server.HandOff()
+			if err != nil {
+				log.Printf("Failed to hand off listeners, %s", err)
+				continue
+			}
+
+			break
+		}
 
-		log.Fatalf("Failed to cleanup in time")
+		shutdownTimeout := config.MaxConnectionTimeLimit() + 1
+		log.Printf("Waiting up to %d seconds for connections to finish", shutdownTimeout)
+		drained <- server.Shutdown(time.Duration(shutdownTimeout) * time.Second)
 	}()
 
 	server.WaitForConnections()
-	server.WaitForCleanup()
+	isDrained := <-drained
+
+	server.StopMetrics()
+	stop()
+
+	// Closing the pool waits for the writes of the last sessions to finish.
+	err = logger.Close()
+	if err != nil {
+		log.Printf("Failed to close database connection %s", err)
+		isDrained = false
+	}
+
+	if !isDrained {
+		os.Exit(1)
+	}
+
+	log.Printf("Shut down cleanly")
+}
+
+func isHandOffSignal(received os.Signal) bool {
+	for _, handOffSignal := range handOffSignals {
+		if received == handOffSignal {
+			return true
+		}
+	}
+	return false
+}
+
+// generateCertificateCommand writes a self-signed certificate for local testing, for
+// when the certificate should be kept somewhere other than the tls_certificate: auto cache.
+func generateCertificateCommand(args []string) error {
+	flags := flag.NewFlagSet("gen-cert", flag.ExitOnError)
+	certFile := flags.String("cert", "cert.pem", "Certificate file to write")
+	keyFile := flags.String("key", "key.pem", "Private key file to write")
+	host := flags.String("host", "localhost", "Comma separated host names and IP addresses")
+	days := flags.Int("days", 365, "Days the certificate is valid for")
+	_ = flags.Parse(args)
+
+	var names []string
+	for _, name := range strings.Split(*host, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+
+	certPEM, keyPEM, err := GenerateCertificate(names, time.Duration(*days)*24*time.Hour)
+	if err != nil {
+		return err
+	}
+
+	err = WriteCertificate(*certFile, *keyFile, certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Wrote certificate for %s to %s and %s", strings.Join(names, ", "), *certFile, *keyFile)
+
+	return nil
 }
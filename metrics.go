@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metricsStoreBuckets are the upper bounds, in seconds, of the store write latency
+// histogram. Writes give up after five seconds.
+var metricsStoreBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+var metricsLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Metrics counts what the server is doing and renders it in the Prometheus text format.
+type Metrics struct {
+	activeConnections  *metricFamily
+	authAttempts       *metricFamily
+	commands           *metricFamily
+	connections        *metricFamily
+	families           []*metricFamily
+	lock               sync.Mutex
+	mails              *metricFamily
+	receivedBytes      *metricFamily
+	storeErrors        *metricFamily
+	storeWriteDuration *metricFamily
+	tlsHandshakes      *metricFamily
+}
+
+type metricFamily struct {
+	buckets    []float64
+	help       string
+	kind       string
+	labelNames []string
+	name       string
+	series     map[string]*metricSeries
+}
+
+type metricSeries struct {
+	bucketCounts []uint64
+	count        uint64
+	labelValues  []string
+	sum          float64
+	value        float64
+}
+
+func CreateMetrics() *Metrics {
+	n := &Metrics{}
+
+	n.activeConnections = n.register(
+		"smtplog_active_connections", "gauge", "Sessions currently open.", "listener",
+	)
+	n.authAttempts = n.register(
+		"smtplog_auth_attempts_total", "counter", "AUTH attempts by mechanism and outcome.", "mechanism", "result",
+	)
+	n.commands = n.register(
+		"smtplog_commands_total", "counter", "Commands handled by verb and reply code.", "command", "code",
+	)
+	n.connections = n.register(
+		"smtplog_connections_total", "counter", "Connections accepted or rejected by a connection limit.", "listener", "result",
+	)
+	n.mails = n.register(
+		"smtplog_mails_total", "counter", "Messages received, by whether they were accepted.", "result",
+	)
+	n.receivedBytes = n.register(
+		"smtplog_received_bytes_total", "counter", "Octets of message data received.",
+	)
+	n.storeErrors = n.register(
+		"smtplog_store_errors_total", "counter", "Failed writes to the database by operation.", "operation",
+	)
+	n.storeWriteDuration = n.register(
+		"smtplog_store_write_duration_seconds", "histogram", "Time taken to write to the database by operation.", "operation",
+	)
+	n.storeWriteDuration.buckets = metricsStoreBuckets
+	n.tlsHandshakes = n.register(
+		"smtplog_tls_handshakes_total", "counter", "TLS handshakes by mode and outcome.", "mode", "result",
+	)
+
+	// Series without labels are reported from the start, so a scrape never misses them.
+	n.add(n.receivedBytes, 0)
+
+	return n
+}
+
+func (n *Metrics) register(name string, kind string, help string, labelNames ...string) *metricFamily {
+	family := &metricFamily{
+		help:       help,
+		kind:       kind,
+		labelNames: labelNames,
+		name:       name,
+		series:     map[string]*metricSeries{},
+	}
+	n.families = append(n.families, family)
+
+	return family
+}
+
+// AddListener reports the series of a listener as zero until it sees its first connection.
+func (n *Metrics) AddListener(listener string) {
+	n.add(n.activeConnections, 0, listener)
+	n.add(n.connections, 0, listener, "accepted")
+	n.add(n.connections, 0, listener, "rejected")
+}
+
+func (n *Metrics) ConnectionAccepted(listener string) {
+	n.add(n.connections, 1, listener, "accepted")
+}
+
+func (n *Metrics) ConnectionRejected(listener string) {
+	n.add(n.connections, 1, listener, "rejected")
+}
+
+func (n *Metrics) ConnectionOpened(listener string) {
+	n.add(n.activeConnections, 1, listener)
+}
+
+func (n *Metrics) ConnectionClosed(listener string) {
+	n.add(n.activeConnections, -1, listener)
+}
+
+func (n *Metrics) CommandHandled(command string, code int) {
+	n.add(n.commands, 1, command, strconv.Itoa(code))
+}
+
+func (n *Metrics) MailReceived(size int, isAccepted bool) {
+	n.add(n.mails, 1, formatMetricsResult(isAccepted, "accepted", "rejected"))
+	n.add(n.receivedBytes, float64(size))
+}
+
+func (n *Metrics) AuthAttempted(mechanism string, isSuccessful bool) {
+	n.add(n.authAttempts, 1, mechanism, formatMetricsResult(isSuccessful, "success", "failure"))
+}
+
+func (n *Metrics) TLSHandshake(mode string, err error) {
+	n.add(n.tlsHandshakes, 1, mode, formatMetricsResult(err == nil, "success", "failure"))
+}
+
+func (n *Metrics) StoreWrite(operation string, duration time.Duration, err error) {
+	n.observe(n.storeWriteDuration, duration.Seconds(), operation)
+	if err != nil {
+		n.add(n.storeErrors, 1, operation)
+	}
+}
+
+func (n *Metrics) add(family *metricFamily, value float64, labelValues ...string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	family.get(labelValues).value += value
+}
+
+func (n *Metrics) observe(family *metricFamily, value float64, labelValues ...string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	series := family.get(labelValues)
+	series.count++
+	series.sum += value
+
+	for i, bound := range family.buckets {
+		if value <= bound {
+			series.bucketCounts[i]++
+		}
+	}
+}
+
+func (n *metricFamily) get(labelValues []string) *metricSeries {
+	key := strings.Join(labelValues, "\xff")
+
+	series := n.series[key]
+	if series == nil {
+		series = &metricSeries{
+			bucketCounts: make([]uint64, len(n.buckets)),
+			labelValues:  labelValues,
+		}
+		n.series[key] = series
+	}
+
+	return series
+}
+
+// ServeHTTP writes every metric in the Prometheus text exposition format.
+func (n *Metrics) ServeHTTP(writer http.ResponseWriter, _ *http.Request) {
+	var output bytes.Buffer
+
+	n.lock.Lock()
+	for _, family := range n.families {
+		family.write(&output)
+	}
+	n.lock.Unlock()
+
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = writer.Write(output.Bytes())
+}
+
+func (n *metricFamily) write(output *bytes.Buffer) {
+	_, _ = fmt.Fprintf(output, "# HELP %s %s\n", n.name, n.help)
+	_, _ = fmt.Fprintf(output, "# TYPE %s %s\n", n.name, n.kind)
+
+	keys := make([]string, 0, len(n.series))
+	for key := range n.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		series := n.series[key]
+
+		if n.kind != "histogram" {
+			_, _ = fmt.Fprintf(output, "%s%s %s\n", n.name, n.formatLabels(series, ""), formatMetricsValue(series.value))
+			continue
+		}
+
+		for i, bound := range n.buckets {
+			_, _ = fmt.Fprintf(
+				output,
+				"%s_bucket%s %d\n",
+				n.name,
+				n.formatLabels(series, formatMetricsValue(bound)),
+				series.bucketCounts[i],
+			)
+		}
+		_, _ = fmt.Fprintf(output, "%s_bucket%s %d\n", n.name, n.formatLabels(series, "+Inf"), series.count)
+		_, _ = fmt.Fprintf(output, "%s_sum%s %s\n", n.name, n.formatLabels(series, ""), formatMetricsValue(series.sum))
+		_, _ = fmt.Fprintf(output, "%s_count%s %d\n", n.name, n.formatLabels(series, ""), series.count)
+	}
+}
+
+// formatLabels renders the labels of a series, adding the le label of a histogram bucket
+// when bound is set.
+func (n *metricFamily) formatLabels(series *metricSeries, bound string) string {
+	labels := make([]string, 0, len(n.labelNames)+1)
+	for i, name := range n.labelNames {
+		labels = append(labels, fmt.Sprintf(`%s="%s"`, name, metricsLabelEscaper.Replace(series.labelValues[i])))
+	}
+
+	if bound != "" {
+		labels = append(labels, fmt.Sprintf(`le="%s"`, bound))
+	}
+
+	if len(labels) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+func formatMetricsValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func formatMetricsResult(isSuccessful bool, success string, failure string) string {
+	if isSuccessful {
+		return success
+	}
+	return failure
+}
+
+// ServeMetrics starts serving the metrics on /metrics at the address, until StopMetrics
+// is called.
+func (n *SMTPServer) ServeMetrics(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", n.metrics)
+
+	n.metricsAddress = address
+	n.metricsServer = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func(server *http.Server) {
+		err := server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Failed to serve metrics, %s", err)
+		}
+	}(n.metricsServer)
+
+	log.Printf("Serving metrics on http://%s/metrics", listener.Addr())
+
+	return nil
+}
+
+func (n *SMTPServer) StopMetrics() {
+	if n.metricsServer == nil {
+		return
+	}
+
+	err := n.metricsServer.Close()
+	if err != nil {
+		log.Printf("Failed to stop serving metrics, %s", err)
+	}
+	n.metricsServer = nil
+}
+
+// metrics returns the metrics of the server the connection belongs to.
+func (n *SMTPConnection) metrics() *Metrics {
+	return n.context.Value(smtpContextKey("metrics")).(*Metrics)
+}
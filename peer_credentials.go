@@ -0,0 +1,8 @@
+package main
+
+// PeerCredentials identifies the process on the other end of a Unix domain socket.
+type PeerCredentials struct {
+	GID uint32
+	PID int32
+	UID uint32
+}
@@ -0,0 +1,40 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+func getPeerCredentials(conn net.Conn) (*PeerCredentials, error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, fmt.Errorf("connection from %s is not a unix socket", conn.RemoteAddr())
+	}
+
+	rawConn, err := unixConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var credentials *syscall.Ucred
+	var credentialsErr error
+
+	err = rawConn.Control(func(fd uintptr) {
+		credentials, credentialsErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if credentialsErr != nil {
+		return nil, credentialsErr
+	}
+
+	return &PeerCredentials{
+		GID: credentials.Gid,
+		PID: credentials.Pid,
+		UID: credentials.Uid,
+	}, nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"net"
+)
+
+// getPeerCredentials returns no credentials, as this platform has no SO_PEERCRED. Unix
+// socket connections are logged without them.
+func getPeerCredentials(_ net.Conn) (*PeerCredentials, error) {
+	return nil, nil
+}
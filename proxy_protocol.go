@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyConn replaces the remote address of a connection with the client address sent in
+// its PROXY protocol header, reading through the buffer used to parse that header.
+type proxyConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	remoteAddr net.Addr
+}
+
+func (n *proxyConn) Read(b []byte) (int, error) {
+	return n.reader.Read(b)
+}
+
+func (n *proxyConn) RemoteAddr() net.Addr {
+	return n.remoteAddr
+}
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header from the connection, returning a
+// connection reporting the original client as its remote address. LOCAL and UNKNOWN
+// headers leave the remote address untouched.
+func readProxyHeader(conn net.Conn, timeout time.Duration) (net.Conn, error) {
+	err := conn.SetReadDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+
+	signature, err := reader.Peek(len(proxyProtocolV2Signature))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read proxy header, %w", err)
+	}
+
+	var remoteAddr net.Addr
+	if bytes.Equal(signature, proxyProtocolV2Signature) {
+		remoteAddr, err = readProxyHeaderV2(reader)
+	} else {
+		remoteAddr, err = readProxyHeaderV1(reader)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+
+	if remoteAddr == nil {
+		remoteAddr = conn.RemoteAddr()
+	}
+
+	return &proxyConn{
+		Conn:       conn,
+		reader:     reader,
+		remoteAddr: remoteAddr,
+	}, nil
+}
+
+func readProxyHeaderV1(reader *bufio.Reader) (net.Addr, error) {
+	// The longest possible v1 header is 107 bytes including the CRLF.
+	var header []byte
+	for len(header) < 107 {
+		char, err := reader.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read proxy header, %w", err)
+		}
+		header = append(header, char)
+		if char == '\n' {
+			break
+		}
+	}
+
+	line := string(header)
+	if !strings.HasPrefix(line, "PROXY ") || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("invalid proxy header")
+	}
+
+	fields := strings.Fields(strings.TrimSuffix(line, "\r\n"))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid proxy header")
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("invalid proxy header source address")
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyHeaderV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read proxy header, %w", err)
+	}
+
+	versionCommand, family := header[12], header[13]
+	if versionCommand>>4 != 2 {
+		return nil, fmt.Errorf("unsupported proxy protocol version %d", versionCommand>>4)
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	_, err = io.ReadFull(reader, payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read proxy header, %w", err)
+	}
+
+	switch versionCommand & 0x0F {
+	case 0x00:
+		// LOCAL, sent by the proxy itself for health checks.
+		return nil, nil
+	case 0x01:
+	default:
+		return nil, fmt.Errorf("unsupported proxy command %d", versionCommand&0x0F)
+	}
+
+	switch family {
+	case 0x11:
+		if len(payload) < 12 {
+			return nil, fmt.Errorf("invalid proxy header length")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:4]),
+			Port: int(binary.BigEndian.Uint16(payload[8:10])),
+		}, nil
+	case 0x21:
+		if len(payload) < 36 {
+			return nil, fmt.Errorf("invalid proxy header length")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:16]),
+			Port: int(binary.BigEndian.Uint16(payload[32:34])),
+		}, nil
+	}
+
+	// Unsupported address families are accepted, but the real address is unknown.
+	return nil, nil
+}
+
+func isTrustedAddress(addr net.Addr, trusted []*net.IPNet) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	for _, network := range trusted {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimitSweepInterval is how often buckets that have refilled completely are dropped.
+const rateLimitSweepInterval = time.Minute
+
+// The client identities limits can be configured for, in the order they are checked.
+const (
+	RateLimitScopeIP     = "ip"
+	RateLimitScopeUser   = "user"
+	RateLimitScopeSender = "sender"
+)
+
+var rateLimitScopes = []string{RateLimitScopeIP, RateLimitScopeUser, RateLimitScopeSender}
+
+// RateLimits are the limits applied to each client of one scope, zero meaning unlimited.
+type RateLimits struct {
+	MessagesPerMinute    int `json:"messages_per_minute"`
+	RecipientsPerHour    int `json:"recipients_per_hour"`
+	RecipientsPerMessage int `json:"recipients_per_message"`
+}
+
+type rateLimitKind struct {
+	limit  func(limits RateLimits) int
+	name   string
+	period time.Duration
+}
+
+var (
+	rateLimitMessages = rateLimitKind{
+		limit:  func(limits RateLimits) int { return limits.MessagesPerMinute },
+		name:   "messages",
+		period: time.Minute,
+	}
+	rateLimitRecipients = rateLimitKind{
+		limit:  func(limits RateLimits) int { return limits.RecipientsPerHour },
+		name:   "recipients",
+		period: time.Hour,
+	}
+)
+
+// RateLimitIdentity is a client as seen by one scope, such as the address it connected
+// from or the user it authenticated as.
+type RateLimitIdentity struct {
+	Scope string
+	Value string
+}
+
+func (n RateLimitIdentity) String() string {
+	return fmt.Sprintf("%s %s", n.Scope, n.Value)
+}
+
+// RateLimiter keeps a token bucket per client identity and kind of limit.
+type RateLimiter struct {
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	limits    map[string]RateLimits
+	lock      sync.Mutex
+}
+
+// tokenBucket holds up to a full period's worth of tokens, refilling continuously.
+type tokenBucket struct {
+	period  time.Duration
+	tokens  float64
+	updated time.Time
+}
+
+func CreateRateLimiter(limits map[string]RateLimits) *RateLimiter {
+	return &RateLimiter{
+		buckets:   map[string]*tokenBucket{},
+		lastSweep: time.Now(),
+		limits:    limits,
+	}
+}
+
+// SetLimits replaces the configured limits. Buckets keep their tokens, capped to the new
+// limits the next time they are used.
+func (n *RateLimiter) SetLimits(limits map[string]RateLimits) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.limits = limits
+}
+
+// Allow returns the first identity out of tokens for the kind of limit, without taking
+// any, or nil if all of them have one left.
+func (n *RateLimiter) Allow(kind rateLimitKind, identities []RateLimitIdentity, now time.Time) *RateLimitIdentity {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	return n.findExhausted(kind, identities, now)
+}
+
+// Take takes a token from every identity if all of them have one left. Otherwise nothing
+// is taken and the first identity out of tokens is returned.
+func (n *RateLimiter) Take(kind rateLimitKind, identities []RateLimitIdentity, now time.Time) *RateLimitIdentity {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	exhausted := n.findExhausted(kind, identities, now)
+	if exhausted != nil {
+		return exhausted
+	}
+
+	n.charge(kind, identities, now)
+	return nil
+}
+
+// Charge takes a token from every identity even if that leaves them in debt, for work
+// that was already allowed and has been done.
+func (n *RateLimiter) Charge(kind rateLimitKind, identities []RateLimitIdentity, now time.Time) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.charge(kind, identities, now)
+}
+
+// RecipientsPerMessage returns the lowest limit on recipients per message that applies to
+// any of the identities, and the identity it comes from.
+func (n *RateLimiter) RecipientsPerMessage(identities []RateLimitIdentity) (int, *RateLimitIdentity) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	var limit int
+	var limitIdentity *RateLimitIdentity
+
+	for i, identity := range identities {
+		scopeLimit := n.limits[identity.Scope].RecipientsPerMessage
+		if scopeLimit > 0 && (limit == 0 || scopeLimit < limit) {
+			limit = scopeLimit
+			limitIdentity = &identities[i]
+		}
+	}
+
+	return limit, limitIdentity
+}
+
+func (n *RateLimiter) findExhausted(kind rateLimitKind, identities []RateLimitIdentity, now time.Time) *RateLimitIdentity {
+	n.sweep(now)
+
+	for i, identity := range identities {
+		bucket := n.bucket(kind, identity, now)
+		if bucket != nil && bucket.tokens < 1 {
+			return &identities[i]
+		}
+	}
+
+	return nil
+}
+
+func (n *RateLimiter) charge(kind rateLimitKind, identities []RateLimitIdentity, now time.Time) {
+	for _, identity := range identities {
+		bucket := n.bucket(kind, identity, now)
+		if bucket != nil {
+			bucket.tokens--
+		}
+	}
+}
+
+// bucket returns the refilled bucket of the identity, or nil if its scope has no limit of
+// this kind.
+func (n *RateLimiter) bucket(kind rateLimitKind, identity RateLimitIdentity, now time.Time) *tokenBucket {
+	limit := float64(kind.limit(n.limits[identity.Scope]))
+	if limit <= 0 {
+		return nil
+	}
+
+	key := fmt.Sprintf("%s:%s:%s", kind.name, identity.Scope, identity.Value)
+
+	bucket := n.buckets[key]
+	if bucket == nil {
+		bucket = &tokenBucket{
+			period:  kind.period,
+			tokens:  limit,
+			updated: now,
+		}
+		n.buckets[key] = bucket
+	}
+
+	if elapsed := now.Sub(bucket.updated); elapsed > 0 {
+		bucket.tokens += limit * elapsed.Seconds() / kind.period.Seconds()
+		bucket.updated = now
+	}
+
+	if bucket.tokens > limit {
+		bucket.tokens = limit
+	}
+
+	return bucket
+}
+
+// sweep drops the buckets that have not been used for a whole period, as they would be
+// full again and are no different to a new one.
+func (n *RateLimiter) sweep(now time.Time) {
+	if now.Sub(n.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	n.lastSweep = now
+
+	for key, bucket := range n.buckets {
+		if now.Sub(bucket.updated) >= bucket.period {
+			delete(n.buckets, key)
+		}
+	}
+}
+
+func (n *SMTPConnection) rateLimiter() *RateLimiter {
+	return n.context.Value(smtpContextKey("rateLimiter")).(*RateLimiter)
+}
+
+// rateLimitIdentities returns the identities of the client sending a message from the
+// sender. Identities that are not known, such as the user before AUTH, are left out.
+func (n *SMTPConnection) rateLimitIdentities(sender string) []RateLimitIdentity {
+	identities := make([]RateLimitIdentity, 0, len(rateLimitScopes))
+
+	if n.record.RemoteAddress != "" {
+		identities = append(identities, RateLimitIdentity{Scope: RateLimitScopeIP, Value: n.record.RemoteAddress})
+	}
+
+	if user := n.authenticatedUser(); user != "" {
+		identities = append(identities, RateLimitIdentity{Scope: RateLimitScopeUser, Value: user})
+	}
+
+	if sender != "" {
+		identities = append(identities, RateLimitIdentity{Scope: RateLimitScopeSender, Value: strings.ToLower(sender)})
+	}
+
+	return identities
+}
@@ -1,15 +1,22 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"crypto/tls"
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/textproto"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -21,6 +28,12 @@ const (
 	CommandResultDisconnect
 )
 
+// errLineTooLong is returned when a command line is longer than the configured maximum.
+var errLineTooLong = errors.New("line too long")
+
+// maxTextLineLength is the maximum length of a line of message text, excluding the CRLF.
+const maxTextLineLength = 998
+
 type AuthenticationMechanism int
 
 const (
@@ -30,9 +43,24 @@ const (
 )
 
 type SMTPMessage struct {
-	data string
-	from string
-	to   []string
+	bodyType      string
+	data          []byte
+	declaredSize  int64
+	dsnEnvelopeID string
+	dsnReturn     string
+	from          string
+	hasBareLF     bool
+	hasLongLine   bool
+	isChunked     bool
+	parameters    map[string]string
+	to            []SMTPRecipient
+}
+
+type SMTPRecipient struct {
+	address              string
+	dsnNotify            string
+	dsnOriginalRecipient string
+	parameters           map[string]string
 }
 
 type SMTPConnection struct {
@@ -41,64 +69,116 @@ type SMTPConnection struct {
 	cancel          context.CancelFunc
 	context         context.Context
 	connectionID    int64
-	isDisconnecting bool
-	isReadingData   bool
+	connectionULID  string
+	disconnecting   int32
+	errorCount      int
+	isAuthenticated bool
+	isExtended      bool
+	isHeloForwarded bool
 	isReadingAuth   bool
 	message         SMTPMessage
 	netConnection   net.Conn
+	rawConnection   net.Conn
+	record          ConnectionRecord
+	responder       *SMTPResponder
 	textConnection  *textproto.Conn
+
+	// Whether the session is waiting for its next command, guarded as it is checked by
+	// the server when shutting down.
+	idleLock sync.Mutex
+	isIdle   bool
+
+	// The reverse DNS of the client, looked up when it first greets and replaced by the
+	// NAME forwarded with XCLIENT or XFORWARD.
+	isReverseNameForwarded bool
+	reverseLookupAddress   string
+	reverseNames           []string
 }
 
 type SMTPResponse struct {
 	code    int
 	partial bool
+	status  EnhancedStatusCode
 	message string
 }
 
 type SMTPResponder struct {
 	connection *SMTPConnection
+	lastCode   int
 	messages   []*SMTPResponse
 }
 
+// sendMessages writes all the messages to the connection at once, so a group of pipelined
+// commands is answered with a single write.
 func sendMessages(connection *SMTPConnection, messages []*SMTPResponse) {
+	err := connection.netConnection.SetWriteDeadline(time.Now().Add(time.Second * 1))
+	if err != nil {
+		log.Printf("Failed to set write deadline on %s, %s", connection.netConnection.RemoteAddr(), err)
+	}
+
 	for _, message := range messages {
 		separator := " "
 		if message.partial {
 			separator = "-"
 		}
 
-		err := connection.netConnection.SetWriteDeadline(time.Now().Add(time.Second * 1))
-		if err != nil {
-			log.Printf("Failed to set write deadline on %s, %s", connection.netConnection.RemoteAddr(), err)
-		}
-
 		output := fmt.Sprintf("%d%s%s", message.code, separator, message.message)
+		if !message.status.IsZero() {
+			output = fmt.Sprintf("%d%s%s %s", message.code, separator, message.status, message.message)
+		}
 
 		log.Printf("> %s", output)
 
-		err = connection.writeOutput(output)
+		connection.writeOutput(output)
+	}
 
-		// Since 221 is the response to a quit command, we don't want to log it as an error
-		// in case it was just a client that closed the connection before reading.
-		if err != nil && message.code != 221 {
-			log.Printf("Failed to send %d to %s", message.code, connection.netConnection.RemoteAddr())
-		}
+	err = connection.textConnection.W.Flush()
+
+	// Since 221 is the response to a quit command, we don't want to log it as an error
+	// in case it was just a client that closed the connection before reading.
+	lastCode := messages[len(messages)-1].code
+	if err != nil && lastCode != 221 {
+		log.Printf("Failed to send %d to %s", lastCode, connection.netConnection.RemoteAddr())
 	}
 }
 
 func (n *SMTPMessage) HasRecipient(address string) bool {
 	for _, to := range n.to {
-		if to == address {
+		if to.address == address {
 			return true
 		}
 	}
 	return false
 }
 
+func (n *SMTPMessage) RecipientAddresses() []string {
+	addresses := make([]string, 0, len(n.to))
+	for _, to := range n.to {
+		addresses = append(addresses, to.address)
+	}
+	return addresses
+}
+
 func (n *SMTPResponder) Respond(response *SMTPResponse) {
+	// RFC 2034 only allows enhanced status codes once the extension has been advertised.
+	// This is decided now, as a pipelined HELO could end the extended session before the
+	// replies are sent.
+	if !response.status.IsZero() && !n.connection.hasEnhancedStatusCodes() {
+		response = &SMTPResponse{
+			code:    response.code,
+			partial: response.partial,
+			message: response.message,
+		}
+	}
+
+	n.lastCode = response.code
 	n.messages = append(n.messages, response)
 }
 
+func (n *SMTPConnection) hasEnhancedStatusCodes() bool {
+	return n.isExtended || n.context.Value(smtpContextKey("isLMTP")).(bool)
+}
+
 func (n *SMTPResponder) Flush() {
 	if n.messages == nil || len(n.messages) == 0 {
 		return
@@ -109,53 +189,241 @@ func (n *SMTPResponder) Flush() {
 }
 
 func (n *SMTPConnection) SendBanner() {
-	sendMessages(n, []*SMTPResponse{
-		{
-			code: 220,
-			message: fmt.Sprintf(
-				"%s ESMTP %s",
-				n.context.Value(smtpContextKey("bannerHost")).(string),
-				n.context.Value(smtpContextKey("bannerName")).(string),
-			),
-		},
-	})
+	sendMessages(n, []*SMTPResponse{n.bannerResponse()})
 }
 
-func (n *SMTPConnection) writeOutput(output string) error {
+func (n *SMTPConnection) bannerResponse() *SMTPResponse {
+	protocol := "ESMTP"
+	if n.context.Value(smtpContextKey("isLMTP")).(bool) {
+		protocol = "LMTP"
+	}
+
+	return &SMTPResponse{
+		code: 220,
+		message: fmt.Sprintf(
+			"%s %s %s",
+			n.context.Value(smtpContextKey("bannerHost")).(string),
+			protocol,
+			n.context.Value(smtpContextKey("bannerName")).(string),
+		),
+	}
+}
+
+func (n *SMTPConnection) writeOutput(output string) {
 	n.logMessage(LogDirectionOut, []byte(output))
 
-	return n.textConnection.PrintfLine(output)
+	// Errors are returned by the flush at the end of sendMessages.
+	_, _ = n.textConnection.W.WriteString(output + "\r\n")
 }
 
-func (n *SMTPConnection) readInput() (string, error) {
-	err := n.netConnection.SetReadDeadline(time.Now().Add(
+// hasBufferedCommand reports whether a complete command line has already been received,
+// in which case the replies to the current group of pipelined commands can be held back.
+func (n *SMTPConnection) hasBufferedCommand() bool {
+	buffered, _ := n.textConnection.R.Peek(n.textConnection.R.Buffered())
+
+	return bytes.IndexByte(buffered, '\n') >= 0
+}
+
+// setDisconnecting marks the session to end at the next command. It is called from other
+// goroutines, so the flag is accessed atomically.
+func (n *SMTPConnection) setDisconnecting() {
+	atomic.StoreInt32(&n.disconnecting, 1)
+}
+
+func (n *SMTPConnection) isDisconnecting() bool {
+	return atomic.LoadInt32(&n.disconnecting) == 1
+}
+
+func (n *SMTPConnection) setIdle(isIdle bool) {
+	n.idleLock.Lock()
+	defer n.idleLock.Unlock()
+
+	n.isIdle = isIdle
+}
+
+// interruptIfIdle wakes a session that is waiting for its next command, so it notices it
+// is disconnecting without waiting for the client.
+func (n *SMTPConnection) interruptIfIdle() {
+	n.idleLock.Lock()
+	defer n.idleLock.Unlock()
+
+	if n.isIdle {
+		_ = n.rawConnection.SetReadDeadline(time.Now())
+	}
+}
+
+func (n *SMTPConnection) setReadDeadline() error {
+	return n.netConnection.SetReadDeadline(time.Now().Add(
 		time.Duration(n.context.Value(smtpContextKey("readTimeout")).(int)) * time.Second,
 	))
+}
+
+func (n *SMTPConnection) readInput() (string, error) {
+	err := n.setReadDeadline()
 	if err != nil {
 		return "", err
 	}
 
-	input, err := n.textConnection.ReadLine()
+	// A shutdown that interrupted the session before the deadline above was set would
+	// otherwise go unnoticed until the client sends something.
+	if n.isDisconnecting() && !n.hasBufferedCommand() {
+		return "", os.ErrDeadlineExceeded
+	}
 
-	if err == nil {
-		n.logMessage(LogDirectionIn, []byte(input))
+	maxLineLength := n.context.Value(smtpContextKey("maxLineLength")).(int)
+	if maxLineLength <= 0 {
+		input, err := n.textConnection.ReadLine()
+		if err == nil {
+			n.logMessage(LogDirectionIn, []byte(input))
+		}
+		return input, err
+	}
+
+	return n.readLimitedLine(maxLineLength)
+}
+
+// readLimitedLine reads a line of at most maxLength octets excluding the line ending. A
+// longer line is read to its end and discarded, only its start is kept for the log.
+func (n *SMTPConnection) readLimitedLine(maxLength int) (string, error) {
+	var line []byte
+	isTooLong := false
+
+	for {
+		chunk, err := n.textConnection.R.ReadSlice('\n')
+		if !isTooLong {
+			line = append(line, chunk...)
+			if len(line) > maxLength+2 {
+				line = line[:maxLength]
+				isTooLong = true
+			}
+		}
+
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		break
+	}
+
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	line = bytes.TrimSuffix(line, []byte("\r"))
+
+	if len(line) > maxLength {
+		line = line[:maxLength]
+		isTooLong = true
+	}
+
+	n.logMessage(LogDirectionIn, line)
+
+	if isTooLong {
+		return "", errLineTooLong
+	}
+
+	return string(line), nil
+}
+
+func (n *SMTPConnection) readChunk(size int64) ([]byte, error) {
+	err := n.setReadDeadline()
+	if err != nil {
+		return nil, err
+	}
+
+	var chunk bytes.Buffer
+	_, err = io.CopyN(&chunk, n.textConnection.R, size)
+	if err != nil {
+		return nil, err
 	}
 
-	return input, err
+	n.logMessage(LogDirectionIn, chunk.Bytes())
+
+	return chunk.Bytes(), nil
+}
+
+// discardChunk reads a BDAT chunk that is being rejected without keeping it.
+func (n *SMTPConnection) discardChunk(size int64) error {
+	err := n.setReadDeadline()
+	if err != nil {
+		return err
+	}
+
+	_, err = io.CopyN(io.Discard, n.textConnection.R, size)
+	return err
+}
+
+// readPayload reads the raw DATA stream up to and including the terminating dot line,
+// returning everything before the terminator with its original line endings intact, the
+// number of octets that made it up, and whether the terminator ended in a bare LF.
+//
+// A dot line ending in a bare LF also ends the data, as mailers that send bare LF
+// throughout would otherwise never finish their message.
+//
+// Once the data exceeds maxSize the rest is read and discarded, so an oversized message
+// cannot use more memory than an accepted one.
+func (n *SMTPConnection) readPayload(maxSize int64) ([]byte, int64, bool, error) {
+	var payload bytes.Buffer
+	var size int64
+	var isBareLFEnd bool
+	isLineStart := true
+
+	for {
+		err := n.setReadDeadline()
+		if err != nil {
+			return nil, 0, false, err
+		}
+
+		// Lines are read in pieces no larger than the read buffer, so a long line is not
+		// held in memory more than once.
+		fragment, err := n.textConnection.R.ReadSlice('\n')
+		isLineEnd := err == nil
+		if err != nil && !errors.Is(err, bufio.ErrBufferFull) {
+			return nil, 0, false, err
+		}
+
+		if isLineStart && isLineEnd && (bytes.Equal(fragment, []byte(".\r\n")) || bytes.Equal(fragment, []byte(".\n"))) {
+			isBareLFEnd = len(fragment) == 2
+			break
+		}
+
+		size += int64(len(fragment))
+		if maxSize <= 0 || size <= maxSize {
+			payload.Write(fragment)
+		}
+
+		isLineStart = isLineEnd
+	}
+
+	n.logMessage(LogDirectionIn, payload.Bytes())
+
+	return payload.Bytes(), size, isBareLFEnd, nil
 }
 
 func (n *SMTPConnection) logMessage(
 	direction LogDirection,
 	data []byte,
 ) {
+	started := time.Now()
 	_, err := n.context.Value(smtpContextKey("logger")).(*DatabaseLogger).LogMessage(n.connectionID, direction, data)
+	n.metrics().StoreWrite("message", time.Since(started), err)
 	if err != nil {
 		log.Printf("Failed to log message, %s", err)
 	}
 }
 
+func (n *SMTPConnection) updateConnection() {
+	started := time.Now()
+	err := n.context.Value(smtpContextKey("logger")).(*DatabaseLogger).UpdateConnection(n.connectionID, n.record)
+	n.metrics().StoreWrite("update_connection", time.Since(started), err)
+	if err != nil {
+		log.Printf("Failed to update connection, %s", err)
+	}
+}
+
 func (n *SMTPConnection) logMail(message SMTPMessage) {
+	started := time.Now()
 	_, err := n.context.Value(smtpContextKey("logger")).(*DatabaseLogger).LogMail(n.connectionID, message)
+	n.metrics().StoreWrite("mail", time.Since(started), err)
 	if err != nil {
 		log.Printf("Failed to log mail, %s", err)
 	}
@@ -167,21 +435,79 @@ func (n *SMTPConnection) WaitForCommands() {
 		case <-n.context.Done():
 			return
 		default:
+			n.setIdle(true)
 			netData, err := n.readInput()
-			if err != nil {
-				if !n.canRetryError(err) {
-					return
+			n.setIdle(false)
+
+			var result CommandResult
+			switch {
+			case errors.Is(err, errLineTooLong):
+				result = handleLongLine(n.responder, n)
+			case err != nil:
+				if n.canRetryError(err) {
+					continue
 				}
-				continue
+
+				// An idle session interrupted by a shutdown is still connected and told so.
+				if n.isDisconnecting() && isTimeout(err) {
+					n.responder.Respond(closingResponse())
+					n.responder.Flush()
+				}
+				return
+			default:
+				result = n.HandleCommand(netData)
+			}
+
+			result = n.checkErrorLimit(result)
+
+			if result == CommandResultDisconnect || !n.hasBufferedCommand() {
+				n.responder.Flush()
 			}
 
-			if n.HandleCommand(netData) == CommandResultDisconnect {
+			if result == CommandResultDisconnect {
 				return
 			}
 		}
 	}
 }
 
+// checkErrorLimit counts the consecutive commands that failed, ending the session once
+// there have been too many so a broken or hostile client cannot keep it open.
+func (n *SMTPConnection) checkErrorLimit(result CommandResult) CommandResult {
+	switch result {
+	case CommandResultOK:
+		n.errorCount = 0
+	case CommandResultError:
+		n.errorCount++
+	}
+
+	maxErrors := n.context.Value(smtpContextKey("maxErrors")).(int)
+	if maxErrors <= 0 || n.errorCount < maxErrors {
+		return result
+	}
+
+	log.Printf("Disconnecting %s after %d consecutive errors", n.record, n.errorCount)
+	n.responder.Respond(&SMTPResponse{
+		code:    421,
+		status:  EnhancedStatusPolicyDeferred,
+		message: "Too many errors, closing transmission channel",
+	})
+	return CommandResultDisconnect
+}
+
+func closingResponse() *SMTPResponse {
+	return &SMTPResponse{
+		code:    421,
+		status:  EnhancedStatusServiceUnavailable,
+		message: "Service not available, closing transmission channel",
+	}
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
 func (n *SMTPConnection) canRetryError(err error) bool {
 	var opErr *net.OpError
 	if errors.As(err, &opErr) && opErr.Temporary() {
@@ -190,7 +516,7 @@ func (n *SMTPConnection) canRetryError(err error) bool {
 			time.Sleep(time.Millisecond * 100)
 		}
 
-		if n.isDisconnecting {
+		if n.isDisconnecting() {
 			return false
 		}
 
@@ -203,22 +529,14 @@ func (n *SMTPConnection) canRetryError(err error) bool {
 func (n *SMTPConnection) HandleCommand(input string) CommandResult {
 	log.Printf("< %s", input)
 
-	responder := SMTPResponder{
-		connection: n,
-		messages:   make([]*SMTPResponse, 0),
-	}
-
-	defer responder.Flush()
+	responder := n.responder
 
-	if n.isDisconnecting {
-		responder.Respond(&SMTPResponse{
-			code:    421,
-			message: "Service not available, closing transmission channel",
-		})
+	if n.isDisconnecting() {
+		responder.Respond(closingResponse())
 		return CommandResultDisconnect
 	}
 
-	if !n.isReadingData && len(input) == 0 {
+	if len(input) == 0 {
 		return CommandResultDisconnect
 	}
 
@@ -230,16 +548,17 @@ func (n *SMTPConnection) HandleCommand(input string) CommandResult {
 	command, arguments := parts[0], parts[1]
 	command = strings.ToUpper(command)
 
-	if n.isReadingData {
-		return HandlePayload(&responder, n, input)
-	}
+	// The reply code is counted with the command, the responder remembering the last one.
+	responder.lastCode = 0
 
 	if n.isReadingAuth {
-		return HandleAuthPayload(&responder, n, input)
+		defer n.countCommand("AUTH")
+		return HandleAuthPayload(responder, n, input)
 	}
 
 	smtpCommands := map[string]func(*SMTPResponder, *SMTPConnection, string) CommandResult{
 		"AUTH":     handleAUTH,
+		"BDAT":     handleBDAT,
 		"DATA":     handleDATA,
 		"EHLO":     handleEHLO,
 		"HELO":     handleHELO,
@@ -251,13 +570,30 @@ func (n *SMTPConnection) HandleCommand(input string) CommandResult {
 		"RSET":     handleRSET,
 		"STARTTLS": handleSTARTTLS,
 		"VRFY":     handleVRFY,
+		"XCLIENT":  handleXCLIENT,
+		"XFORWARD": handleXFORWARD,
+	}
+
+	// LMTP replaces HELO and EHLO with LHLO, everything else is shared.
+	if n.context.Value(smtpContextKey("isLMTP")).(bool) {
+		delete(smtpCommands, "EHLO")
+		delete(smtpCommands, "HELO")
+		smtpCommands["LHLO"] = handleEHLO
 	}
 
 	if smtpCommands[command] == nil {
-		return handleUnknownCommand(&responder, n, input)
+		defer n.countCommand("UNKNOWN")
+		return handleUnknownCommand(responder, n, input)
 	}
 
-	return smtpCommands[command](&responder, n, arguments)
+	defer n.countCommand(command)
+	return smtpCommands[command](responder, n, arguments)
+}
+
+func (n *SMTPConnection) countCommand(command string) {
+	if n.responder.lastCode != 0 {
+		n.metrics().CommandHandled(command, n.responder.lastCode)
+	}
 }
 
 func HandleAuthPayload(responder *SMTPResponder, connection *SMTPConnection, input string) CommandResult {
@@ -277,9 +613,12 @@ func HandleAuthPayload(responder *SMTPResponder, connection *SMTPConnection, inp
 			})
 			connection.isReadingAuth = true
 		} else {
+			connection.isAuthenticated = true
+			connection.metrics().AuthAttempted("LOGIN", true)
 			responder.Respond(&SMTPResponse{
 				code:    235,
-				message: "2.7.0 Authentication successful",
+				status:  EnhancedStatusAuthenticated,
+				message: "Authentication successful",
 			})
 		}
 
@@ -290,6 +629,16 @@ func HandleAuthPayload(responder *SMTPResponder, connection *SMTPConnection, inp
 }
 
 func handleAUTH(responder *SMTPResponder, connection *SMTPConnection, input string) CommandResult {
+	if connection.context.Value(smtpContextKey("authPolicy")).(AuthPolicy) == AuthPolicyDisabled {
+		connection.metrics().AuthAttempted(formatAuthMechanism(input), false)
+		responder.Respond(&SMTPResponse{
+			code:    502,
+			status:  EnhancedStatusNotImplemented,
+			message: "Command not implemented",
+		})
+		return CommandResultError
+	}
+
 	parts := strings.SplitN(input, " ", 2)
 	if len(parts) == 1 {
 		parts = append(parts, "")
@@ -303,6 +652,7 @@ func handleAUTH(responder *SMTPResponder, connection *SMTPConnection, input stri
 	}
 
 	if authHandlers[mechanism] == nil {
+		connection.metrics().AuthAttempted(formatAuthMechanism(mechanism), false)
 		return handleUnknownCommand(responder, connection, arguments)
 	}
 
@@ -312,15 +662,28 @@ func handleAUTH(responder *SMTPResponder, connection *SMTPConnection, input stri
 func handleAuthPLAIN(responder *SMTPResponder, connection *SMTPConnection, arguments string) CommandResult {
 	connection.authMechanism = AuthenticationMechanismPlain
 	connection.authLines = []string{arguments}
+	connection.isAuthenticated = true
+	connection.metrics().AuthAttempted("PLAIN", true)
 
 	responder.Respond(&SMTPResponse{
 		code:    235,
-		message: "2.7.0 Authentication successful",
+		status:  EnhancedStatusAuthenticated,
+		message: "Authentication successful",
 	})
 
 	return CommandResultOK
 }
 
+// formatAuthMechanism names the mechanism of an AUTH command for the metrics, grouping
+// the ones that are not supported so clients cannot add labels at will.
+func formatAuthMechanism(input string) string {
+	mechanism := strings.ToUpper(strings.SplitN(input, " ", 2)[0])
+	if mechanism != "LOGIN" && mechanism != "PLAIN" {
+		return "UNKNOWN"
+	}
+	return mechanism
+}
+
 func handleAuthLOGIN(responder *SMTPResponder, connection *SMTPConnection, _ string) CommandResult {
 	connection.authMechanism = AuthenticationMechanismLogin
 	connection.authLines = []string{}
@@ -334,10 +697,123 @@ func handleAuthLOGIN(responder *SMTPResponder, connection *SMTPConnection, _ str
 	return CommandResultOK
 }
 
-func handleDATA(responder *SMTPResponder, connection *SMTPConnection, _ string) CommandResult {
+// authenticatedUser returns the user the client authenticated as, either forwarded with
+// XCLIENT or decoded from the credentials it sent with AUTH.
+func (n *SMTPConnection) authenticatedUser() string {
+	if !n.isAuthenticated {
+		return ""
+	}
+
+	if n.record.Login != "" || len(n.authLines) == 0 {
+		return n.record.Login
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(n.authLines[0])
+	if err != nil {
+		return ""
+	}
+
+	// PLAIN sends the authorization identity, user and password separated by NUL.
+	if n.authMechanism == AuthenticationMechanismPlain {
+		parts := strings.SplitN(string(decoded), "\x00", 3)
+		if len(parts) != 3 {
+			return ""
+		}
+		return parts[1]
+	}
+
+	return string(decoded)
+}
+
+func handleBDAT(responder *SMTPResponder, connection *SMTPConnection, arguments string) CommandResult {
+	parts := strings.Fields(arguments)
+	if len(parts) < 1 || len(parts) > 2 || (len(parts) == 2 && strings.ToUpper(parts[1]) != "LAST") {
+		responder.Respond(&SMTPResponse{
+			code:    501,
+			status:  EnhancedStatusInvalidArguments,
+			message: "Syntax: BDAT <size> [LAST]",
+		})
+		return CommandResultError
+	}
+
+	size, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || size < 0 {
+		responder.Respond(&SMTPResponse{
+			code:    501,
+			status:  EnhancedStatusInvalidArguments,
+			message: "Syntax: BDAT <size> [LAST]",
+		})
+		return CommandResultError
+	}
+
+	isLast := len(parts) == 2
+	maxMessageSize := connection.context.Value(smtpContextKey("maxMessageSize")).(int64)
+
+	// A rejected chunk still has to be consumed, otherwise its contents would be
+	// interpreted as commands, but it is discarded as it is read.
+	var rejection *SMTPResponse
 	if len(connection.message.from) == 0 || len(connection.message.to) == 0 {
+		rejection = &SMTPResponse{
+			code:    503,
+			status:  EnhancedStatusBadSequence,
+			message: "Bad sequence of commands",
+		}
+	} else if maxMessageSize > 0 && int64(len(connection.message.data))+size > maxMessageSize {
+		log.Printf(
+			"< Rejected %d byte chunk from %s, message would exceed %d bytes",
+			size,
+			connection.message.from,
+			maxMessageSize,
+		)
+
+		connection.metrics().MailReceived(len(connection.message.data)+int(size), false)
+		connection.message = SMTPMessage{}
+		rejection = messageTooBigResponse()
+	}
+
+	if rejection != nil {
+		err = connection.discardChunk(size)
+		if err != nil {
+			log.Printf("Failed to read %d byte chunk from %s, %s", size, connection.netConnection.RemoteAddr(), err)
+			return CommandResultDisconnect
+		}
+
+		responder.Respond(rejection)
+		return CommandResultError
+	}
+
+	chunk, err := connection.readChunk(size)
+	if err != nil {
+		log.Printf("Failed to read %d byte chunk from %s, %s", size, connection.netConnection.RemoteAddr(), err)
+		return CommandResultDisconnect
+	}
+
+	connection.message.data = append(connection.message.data, chunk...)
+	connection.message.isChunked = true
+
+	if !isLast {
+		responder.Respond(&SMTPResponse{
+			code:    250,
+			status:  EnhancedStatusOK,
+			message: fmt.Sprintf("%d octets received", size),
+		})
+		return CommandResultOK
+	}
+
+	connection.message.hasBareLF, connection.message.hasLongLine = findLineViolations(connection.message.data)
+
+	deliverMessage(responder, connection)
+	return CommandResultOK
+}
+
+func handleDATA(responder *SMTPResponder, connection *SMTPConnection, _ string) CommandResult {
+	if len(connection.message.from) == 0 ||
+		len(connection.message.to) == 0 ||
+		connection.message.isChunked ||
+		connection.message.bodyType == "BINARYMIME" {
 		responder.Respond(&SMTPResponse{
 			code:    503,
+			status:  EnhancedStatusBadSequence,
 			message: "Bad sequence of commands",
 		})
 		return CommandResultError
@@ -348,49 +824,192 @@ func handleDATA(responder *SMTPResponder, connection *SMTPConnection, _ string)
 		message: "End data with <CRLF>.<CRLF>",
 	})
 
-	connection.isReadingData = true
+	responder.Flush()
+
+	maxMessageSize := connection.context.Value(smtpContextKey("maxMessageSize")).(int64)
+
+	payload, size, isBareLFEnd, err := connection.readPayload(maxMessageSize)
+	if err != nil {
+		log.Printf("Failed to read message from %s, %s", connection.netConnection.RemoteAddr(), err)
+		return CommandResultDisconnect
+	}
+
+	if maxMessageSize > 0 && size > maxMessageSize {
+		rejectOversizedMessage(responder, connection, size, maxMessageSize)
+		return CommandResultOK
+	}
+
+	return HandlePayload(responder, connection, payload, isBareLFEnd)
+}
+
+// HandlePayload delivers the message received with DATA. The terminating dot line is not
+// part of the payload, so whether it ended in a bare LF is passed separately.
+func HandlePayload(
+	responder *SMTPResponder,
+	connection *SMTPConnection,
+	payload []byte,
+	isBareLFEnd bool,
+) CommandResult {
+	connection.message.hasBareLF, connection.message.hasLongLine = findLineViolations(payload)
+	connection.message.hasBareLF = connection.message.hasBareLF || isBareLFEnd
+	connection.message.data = unstuffDots(payload)
+
+	deliverMessage(responder, connection)
 	return CommandResultOK
 }
 
-func HandlePayload(responder *SMTPResponder, connection *SMTPConnection, input string) CommandResult {
-	if input == "." {
-		connection.isReadingData = false
-		log.Printf(
-			"< %d byte message from %s to %s",
-			len(connection.message.data),
-			connection.message.from,
-			connection.message.to,
+func deliverMessage(responder *SMTPResponder, connection *SMTPConnection) {
+	recipients := connection.message.to
+
+	maxMessageSize := connection.context.Value(smtpContextKey("maxMessageSize")).(int64)
+	if maxMessageSize > 0 && int64(len(connection.message.data)) > maxMessageSize {
+		rejectOversizedMessage(responder, connection, int64(len(connection.message.data)), maxMessageSize)
+		return
+	}
+
+	log.Printf(
+		"< %d byte message from %s to %s",
+		len(connection.message.data),
+		connection.message.from,
+		connection.message.RecipientAddresses(),
+	)
+
+	if connection.message.hasBareLF {
+		log.Printf("Message from %s contains bare LF line endings", connection.netConnection.RemoteAddr())
+	}
+
+	if connection.message.hasLongLine {
+		log.Printf("Message from %s contains lines longer than %d octets", connection.netConnection.RemoteAddr(), maxTextLineLength)
+	}
+
+	connection.metrics().MailReceived(len(connection.message.data), true)
+
+	if connection.context.Value(smtpContextKey("traceHeaders")).(bool) {
+		connection.message.data = append(
+			connection.traceHeaders(connection.message, time.Now()),
+			connection.message.data...,
 		)
+	}
 
-		connection.logMail(connection.message)
-		connection.message = SMTPMessage{}
+	connection.rateLimiter().Charge(
+		rateLimitMessages,
+		connection.rateLimitIdentities(connection.message.from),
+		time.Now(),
+	)
+
+	connection.logMail(connection.message)
+	connection.message = SMTPMessage{}
+
+	respondDelivery(responder, connection, recipients, &SMTPResponse{
+		code:    250,
+		status:  EnhancedStatusOK,
+		message: "OK",
+	}, true)
+}
+
+func rejectOversizedMessage(responder *SMTPResponder, connection *SMTPConnection, size int64, maxSize int64) {
+	log.Printf(
+		"< Rejected %d byte message from %s, exceeds %d bytes",
+		size,
+		connection.message.from,
+		maxSize,
+	)
+
+	recipients := connection.message.to
+
+	connection.metrics().MailReceived(int(size), false)
+	connection.message = SMTPMessage{}
+
+	respondDelivery(responder, connection, recipients, messageTooBigResponse(), false)
+}
+
+func messageTooBigResponse() *SMTPResponse {
+	return &SMTPResponse{
+		code:    552,
+		status:  EnhancedStatusMessageTooBig,
+		message: "Message size exceeds fixed maximum message size",
+	}
+}
+
+// respondDelivery sends the final reply for a message. LMTP clients expect one reply per
+// recipient instead, which can be overridden per recipient for delivered messages.
+func respondDelivery(
+	responder *SMTPResponder,
+	connection *SMTPConnection,
+	recipients []SMTPRecipient,
+	response *SMTPResponse,
+	isDelivered bool,
+) {
+	if !connection.context.Value(smtpContextKey("isLMTP")).(bool) {
+		responder.Respond(response)
+		return
+	}
+
+	replies := connection.context.Value(smtpContextKey("lmtpReplies")).(map[string]*SMTPResponse)
+
+	for _, recipient := range recipients {
+		reply := response
+		if configured := replies[strings.ToLower(recipient.address)]; isDelivered && configured != nil {
+			reply = configured
+		}
 
 		responder.Respond(&SMTPResponse{
-			code:    250,
-			message: "OK",
+			code:    reply.code,
+			status:  reply.status,
+			message: fmt.Sprintf("<%s> %s", recipient.address, reply.message),
 		})
-	} else {
-		connection.message.data += strings.TrimPrefix(input, ".") + "\n"
 	}
-	return CommandResultOK
 }
 
-func handleEHLO(responder *SMTPResponder, connection *SMTPConnection, _ string) CommandResult {
+func handleEHLO(responder *SMTPResponder, connection *SMTPConnection, arguments string) CommandResult {
+	fields := strings.Fields(arguments)
+	if len(fields) == 0 {
+		responder.Respond(&SMTPResponse{
+			code:    501,
+			status:  EnhancedStatusInvalidArguments,
+			message: "Syntax: EHLO hostname",
+		})
+		return CommandResultError
+	}
+
+	connection.isExtended = true
+	connection.setHeloName(fields[0])
+
 	lines := []string{
 		connection.context.Value(smtpContextKey("bannerHost")).(string),
 		"PIPELINING",
+		"CHUNKING",
+		"ENHANCEDSTATUSCODES",
+		"DSN",
+		"8BITMIME",
+		"BINARYMIME",
+		"SMTPUTF8",
 	}
 
-	authTypes := []string{
-		"LOGIN",
-		"PLAIN",
+	maxMessageSize := connection.context.Value(smtpContextKey("maxMessageSize")).(int64)
+	if maxMessageSize > 0 {
+		lines = append(lines, fmt.Sprintf("SIZE %d", maxMessageSize))
+	} else {
+		lines = append(lines, "SIZE")
 	}
-	authLine := fmt.Sprintf("AUTH %s", strings.Join(authTypes, " "))
 
-	lines = append(lines, authLine)
+	if connection.context.Value(smtpContextKey("authPolicy")).(AuthPolicy) != AuthPolicyDisabled {
+		authTypes := []string{
+			"LOGIN",
+			"PLAIN",
+		}
+		authLine := fmt.Sprintf("AUTH %s", strings.Join(authTypes, " "))
+
+		lines = append(lines, authLine)
+	}
 
 	// TODO Add support for other extensions
 
+	if connection.isXClientTrusted() {
+		lines = append(lines, "XCLIENT NAME ADDR PORT PROTO HELO LOGIN DESTADDR DESTPORT")
+		lines = append(lines, "XFORWARD NAME ADDR PORT PROTO HELO IDENT SOURCE")
+	}
+
 	if connection.context.Value(smtpContextKey("tlsConfig")).(*tls.Config) != nil {
 		lines = append(lines, "STARTTLS")
 	}
@@ -411,7 +1030,20 @@ func handleEHLO(responder *SMTPResponder, connection *SMTPConnection, _ string)
 	return CommandResultOK
 }
 
-func handleHELO(responder *SMTPResponder, connection *SMTPConnection, _ string) CommandResult {
+func handleHELO(responder *SMTPResponder, connection *SMTPConnection, arguments string) CommandResult {
+	fields := strings.Fields(arguments)
+	if len(fields) == 0 {
+		responder.Respond(&SMTPResponse{
+			code:    501,
+			status:  EnhancedStatusInvalidArguments,
+			message: "Syntax: HELO hostname",
+		})
+		return CommandResultError
+	}
+
+	connection.isExtended = false
+	connection.setHeloName(fields[0])
+
 	responder.Respond(&SMTPResponse{
 		code:    250,
 		message: connection.context.Value(smtpContextKey("bannerHost")).(string),
@@ -422,33 +1054,78 @@ func handleHELO(responder *SMTPResponder, connection *SMTPConnection, _ string)
 func handleHELP(responder *SMTPResponder, _ *SMTPConnection, _ string) CommandResult {
 	responder.Respond(&SMTPResponse{
 		code:    214,
+		status:  EnhancedStatusOK,
 		message: "I'm sorry Dave, I'm afraid I can't do that",
 	})
 	return CommandResultOK
 }
 
 func handleMAIL(responder *SMTPResponder, connection *SMTPConnection, arguments string) CommandResult {
+	if connection.context.Value(smtpContextKey("authPolicy")).(AuthPolicy) == AuthPolicyRequired &&
+		!connection.isAuthenticated {
+		responder.Respond(&SMTPResponse{
+			code:    530,
+			status:  EnhancedStatusAuthenticationRequired,
+			message: "Authentication required",
+		})
+		return CommandResultError
+	}
+
 	if len(arguments) < 1 || !strings.HasPrefix(arguments, "FROM:") {
 		responder.Respond(&SMTPResponse{
 			code:    501,
+			status:  EnhancedStatusInvalidArguments,
 			message: "Syntax: MAIL FROM:<address>",
 		})
 		return CommandResultError
 	}
 
 	arguments = strings.TrimPrefix(arguments, "FROM:")
-	address, _, err := splitAddressCommand(arguments)
+	address, parameterArguments, err := splitAddressCommand(arguments)
 	if err != nil {
 		responder.Respond(&SMTPResponse{
 			code:    501,
+			status:  EnhancedStatusBadSenderSyntax,
 			message: "Syntax: MAIL FROM:<address>",
 		})
 		return CommandResultError
 	}
 
-	connection.message.from = address
+	message := SMTPMessage{
+		from: address,
+		to:   connection.message.to,
+	}
+
+	parameters, err := parseESMTPParameters(parameterArguments)
+	if err == nil {
+		err = applyMailParameters(&message, parameters)
+	}
+	if err != nil {
+		respondParameterError(responder, err)
+		return CommandResultError
+	}
+
+	maxMessageSize := connection.context.Value(smtpContextKey("maxMessageSize")).(int64)
+	if maxMessageSize > 0 && message.declaredSize > maxMessageSize {
+		responder.Respond(messageTooBigResponse())
+		return CommandResultError
+	}
+
+	exhausted := connection.rateLimiter().Allow(rateLimitMessages, connection.rateLimitIdentities(address), time.Now())
+	if exhausted != nil {
+		log.Printf("Rate limited MAIL from %s, too many messages for %s", connection.record, exhausted)
+		responder.Respond(&SMTPResponse{
+			code:    451,
+			status:  EnhancedStatusRateLimited,
+			message: "Too many messages, try again later",
+		})
+		return CommandResultError
+	}
+
+	connection.message = message
 	responder.Respond(&SMTPResponse{
 		code:    250,
+		status:  EnhancedStatusSenderOK,
 		message: "OK",
 	})
 	return CommandResultOK
@@ -457,6 +1134,7 @@ func handleMAIL(responder *SMTPResponder, connection *SMTPConnection, arguments
 func handleNOOP(responder *SMTPResponder, _ *SMTPConnection, _ string) CommandResult {
 	responder.Respond(&SMTPResponse{
 		code:    250,
+		status:  EnhancedStatusOK,
 		message: "OK",
 	})
 	return CommandResultOK
@@ -465,6 +1143,7 @@ func handleNOOP(responder *SMTPResponder, _ *SMTPConnection, _ string) CommandRe
 func handleQUIT(responder *SMTPResponder, _ *SMTPConnection, _ string) CommandResult {
 	responder.Respond(&SMTPResponse{
 		code:    221,
+		status:  EnhancedStatusOK,
 		message: "Service closing transmission channel",
 	})
 	return CommandResultDisconnect
@@ -474,36 +1153,88 @@ func handleRCPT(responder *SMTPResponder, connection *SMTPConnection, arguments
 	if len(arguments) < 1 || !strings.HasPrefix(arguments, "TO:") {
 		responder.Respond(&SMTPResponse{
 			code:    501,
+			status:  EnhancedStatusInvalidArguments,
 			message: "Syntax: RCPT TO:<address>",
 		})
 		return CommandResultError
 	}
 
 	arguments = strings.TrimPrefix(arguments, "TO:")
-	address, _, err := splitAddressCommand(arguments)
+	address, parameterArguments, err := splitAddressCommand(arguments)
 	if err != nil {
 		responder.Respond(&SMTPResponse{
 			code:    501,
+			status:  EnhancedStatusBadRecipientSyntax,
 			message: "Syntax: RCPT TO:<address>",
 		})
 		return CommandResultError
 	}
 
+	recipient := SMTPRecipient{address: address}
+
+	parameters, err := parseESMTPParameters(parameterArguments)
+	if err == nil {
+		err = applyRecipientParameters(&recipient, parameters)
+	}
+	if err != nil {
+		respondParameterError(responder, err)
+		return CommandResultError
+	}
+
 	if !connection.message.HasRecipient(address) {
-		connection.message.to = append(connection.message.to, address)
+		maxRecipients := connection.context.Value(smtpContextKey("maxRecipients")).(int)
+		if maxRecipients > 0 && len(connection.message.to) >= maxRecipients {
+			log.Printf("< Rejected RCPT from %s, more than %d recipients", connection.record, maxRecipients)
+			responder.Respond(tooManyRecipientsResponse())
+			return CommandResultError
+		}
+
+		identities := connection.rateLimitIdentities(connection.message.from)
+
+		limit, limitIdentity := connection.rateLimiter().RecipientsPerMessage(identities)
+		if limit > 0 && len(connection.message.to) >= limit {
+			log.Printf("Rate limited RCPT from %s, more than %d recipients for %s", connection.record, limit, limitIdentity)
+			responder.Respond(tooManyRecipientsResponse())
+			return CommandResultError
+		}
+
+		exhausted := connection.rateLimiter().Take(rateLimitRecipients, identities, time.Now())
+		if exhausted != nil {
+			log.Printf("Rate limited RCPT from %s, too many recipients for %s", connection.record, exhausted)
+			responder.Respond(&SMTPResponse{
+				code:    451,
+				status:  EnhancedStatusRateLimited,
+				message: "Too many recipients, try again later",
+			})
+			return CommandResultError
+		}
+
+		connection.message.to = append(connection.message.to, recipient)
 	}
 
 	responder.Respond(&SMTPResponse{
 		code:    250,
+		status:  EnhancedStatusRecipientOK,
 		message: "OK",
 	})
 	return CommandResultOK
 }
 
+// tooManyRecipientsResponse tells the client to send the remaining recipients in another
+// transaction, as described in RFC 5321 section 4.5.3.1.10.
+func tooManyRecipientsResponse() *SMTPResponse {
+	return &SMTPResponse{
+		code:    452,
+		status:  EnhancedStatusTooManyRecipients,
+		message: "Too many recipients",
+	}
+}
+
 func handleRSET(responder *SMTPResponder, connection *SMTPConnection, _ string) CommandResult {
 	connection.message = SMTPMessage{}
 	responder.Respond(&SMTPResponse{
 		code:    250,
+		status:  EnhancedStatusOK,
 		message: "OK",
 	})
 	return CommandResultOK
@@ -514,6 +1245,7 @@ func handleSTARTTLS(responder *SMTPResponder, connection *SMTPConnection, _ stri
 	if tlsConfig == nil {
 		responder.Respond(&SMTPResponse{
 			code:    502,
+			status:  EnhancedStatusNotImplemented,
 			message: "Command not implemented",
 		})
 		return CommandResultError
@@ -521,16 +1253,31 @@ func handleSTARTTLS(responder *SMTPResponder, connection *SMTPConnection, _ stri
 
 	responder.Respond(&SMTPResponse{
 		code:    220,
+		status:  EnhancedStatusOK,
 		message: "Ready to start TLS",
 	})
 	responder.Flush()
 
+	// Anything the client sent after STARTTLS but before the handshake was received in
+	// plaintext and must not be treated as part of the encrypted session.
+	buffered := connection.textConnection.R.Buffered()
+	if buffered > 0 {
+		log.Printf(
+			"Discarding %d bytes received from %s before TLS handshake",
+			buffered,
+			connection.netConnection.RemoteAddr(),
+		)
+		_, _ = connection.textConnection.R.Discard(buffered)
+	}
+
 	tlsConn := tls.Server(connection.netConnection, tlsConfig)
 
 	err := tlsConn.Handshake()
+	connection.metrics().TLSHandshake("starttls", err)
 	if err != nil {
 		responder.Respond(&SMTPResponse{
 			code:    550,
+			status:  EnhancedStatusSecurityError,
 			message: "Failed to start TLS",
 		})
 		return CommandResultDisconnect
@@ -538,12 +1285,38 @@ func handleSTARTTLS(responder *SMTPResponder, connection *SMTPConnection, _ stri
 
 	connection.netConnection = tlsConn
 	connection.textConnection = textproto.NewConn(tlsConn)
+
+	connection.record.TLS = createTLSDetails(tlsConn.ConnectionState())
+	connection.updateConnection()
+
+	// The session starts over once TLS is established.
+	connection.authMechanism = AuthenticationMechanismNone
+	connection.authLines = nil
+	connection.isAuthenticated = false
+	connection.isExtended = false
+	connection.isReadingAuth = false
+	connection.message = SMTPMessage{}
 	return CommandResultOK
 }
 
+func handleLongLine(responder *SMTPResponder, connection *SMTPConnection) CommandResult {
+	log.Printf("< Line from %s exceeds %d octets", connection.record, connection.context.Value(smtpContextKey("maxLineLength")).(int))
+
+	// A line too long to be an AUTH response cancels the exchange.
+	connection.isReadingAuth = false
+
+	responder.Respond(&SMTPResponse{
+		code:    500,
+		status:  EnhancedStatusSyntaxError,
+		message: "Line too long",
+	})
+	return CommandResultError
+}
+
 func handleUnknownCommand(responder *SMTPResponder, _ *SMTPConnection, _ string) CommandResult {
 	responder.Respond(&SMTPResponse{
 		code:    500,
+		status:  EnhancedStatusUnrecognizedCommand,
 		message: "Command not recognized",
 	})
 	return CommandResultError
@@ -552,13 +1325,31 @@ func handleUnknownCommand(responder *SMTPResponder, _ *SMTPConnection, _ string)
 func handleVRFY(responder *SMTPResponder, _ *SMTPConnection, _ string) CommandResult {
 	responder.Respond(&SMTPResponse{
 		code:    252,
+		status:  EnhancedStatusOK,
 		message: "Cannot VRFY",
 	})
 	return CommandResultOK
 }
 
+func respondParameterError(responder *SMTPResponder, err error) {
+	if errors.Is(err, errUnsupportedParameter) {
+		responder.Respond(&SMTPResponse{
+			code:    555,
+			status:  EnhancedStatusInvalidArguments,
+			message: fmt.Sprintf("Parameters not recognized or not implemented, %s", err),
+		})
+		return
+	}
+
+	responder.Respond(&SMTPResponse{
+		code:    501,
+		status:  EnhancedStatusInvalidArguments,
+		message: fmt.Sprintf("Syntax error in parameters, %s", err),
+	})
+}
+
 func splitAddressCommand(arguments string) (string, string, error) {
-	if len(arguments) < 1 || !strings.HasPrefix(arguments, "<") || !strings.HasSuffix(arguments, ">") {
+	if len(arguments) < 1 || !strings.HasPrefix(arguments, "<") || !strings.Contains(arguments, ">") {
 		return "", "", fmt.Errorf("invalid address")
 	}
 
@@ -570,3 +1361,45 @@ func splitAddressCommand(arguments string) (string, string, error) {
 
 	return strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]), nil
 }
+
+// findLineViolations reports whether the data contains any line terminated by a bare LF
+// instead of CRLF, and whether any line exceeds the RFC 5321 text line limit.
+func findLineViolations(data []byte) (hasBareLF bool, hasLongLine bool) {
+	for len(data) > 0 {
+		line := data
+		index := bytes.IndexByte(data, '\n')
+		if index >= 0 {
+			line = data[:index]
+			data = data[index+1:]
+
+			if len(line) == 0 || line[len(line)-1] != '\r' {
+				hasBareLF = true
+			} else {
+				line = line[:len(line)-1]
+			}
+		} else {
+			data = nil
+		}
+
+		if len(line) > maxTextLineLength {
+			hasLongLine = true
+		}
+	}
+
+	return hasBareLF, hasLongLine
+}
+
+// unstuffDots removes the leading dot added by the client to any line starting with a dot.
+func unstuffDots(data []byte) []byte {
+	unstuffed := make([]byte, 0, len(data))
+	isLineStart := true
+
+	for _, char := range data {
+		if !(isLineStart && char == '.') {
+			unstuffed = append(unstuffed, char)
+		}
+		isLineStart = char == '\n'
+	}
+
+	return unstuffed
+}
@@ -0,0 +1,516 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testDriverName is the database/sql driver standing in for MySQL in tests. Each data
+// source name is a separate database recording the statements executed against it.
+const testDriverName = "smtplogtest"
+
+var testDatabases = struct {
+	databases map[string]*testDatabase
+	lock      sync.Mutex
+}{databases: map[string]*testDatabase{}}
+
+func init() {
+	sql.Register(testDriverName, testDriver{})
+}
+
+type testDatabase struct {
+	lock       sync.Mutex
+	statements []testStatement
+}
+
+type testStatement struct {
+	arguments []driver.Value
+	query     string
+}
+
+// find returns the arguments of every executed statement starting with the query prefix.
+func (n *testDatabase) find(prefix string) [][]driver.Value {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	var found [][]driver.Value
+	for _, statement := range n.statements {
+		if strings.HasPrefix(statement.query, prefix) {
+			found = append(found, statement.arguments)
+		}
+	}
+
+	return found
+}
+
+type testDriver struct{}
+
+func (testDriver) Open(name string) (driver.Conn, error) {
+	testDatabases.lock.Lock()
+	defer testDatabases.lock.Unlock()
+
+	database := testDatabases.databases[name]
+	if database == nil {
+		database = &testDatabase{}
+		testDatabases.databases[name] = database
+	}
+
+	return testConn{database: database}, nil
+}
+
+type testConn struct {
+	database *testDatabase
+}
+
+func (n testConn) Prepare(query string) (driver.Stmt, error) {
+	return testStmt{database: n.database, query: query}, nil
+}
+
+func (testConn) Close() error {
+	return nil
+}
+
+func (testConn) Begin() (driver.Tx, error) {
+	return nil, fmt.Errorf("transactions are not supported")
+}
+
+type testStmt struct {
+	database *testDatabase
+	query    string
+}
+
+func (testStmt) Close() error {
+	return nil
+}
+
+func (testStmt) NumInput() int {
+	return -1
+}
+
+func (n testStmt) Exec(arguments []driver.Value) (driver.Result, error) {
+	n.database.lock.Lock()
+	defer n.database.lock.Unlock()
+
+	n.database.statements = append(n.database.statements, testStatement{arguments: arguments, query: n.query})
+
+	return testResult{id: int64(len(n.database.statements))}, nil
+}
+
+func (testStmt) Query([]driver.Value) (driver.Rows, error) {
+	return testRows{}, nil
+}
+
+type testResult struct {
+	id int64
+}
+
+func (n testResult) LastInsertId() (int64, error) {
+	return n.id, nil
+}
+
+func (testResult) RowsAffected() (int64, error) {
+	return 1, nil
+}
+
+type testRows struct{}
+
+func (testRows) Columns() []string {
+	return []string{"id"}
+}
+
+func (testRows) Close() error {
+	return nil
+}
+
+func (testRows) Next([]driver.Value) error {
+	return io.EOF
+}
+
+// startTestServer starts a server with the listeners, logging to a database of its own,
+// and shuts it down when the test ends.
+func startTestServer(
+	t *testing.T,
+	ctx context.Context,
+	listeners ...*ListenerConfiguration,
+) (*SMTPServer, *testDatabase) {
+	t.Helper()
+
+	dataSourceName := fmt.Sprintf("%s-%d", t.Name(), time.Now().UnixNano())
+
+	logger, err := CreateDatabaseLogger(ctx, testDriverName+"://"+dataSourceName)
+	if err != nil {
+		t.Fatalf("Failed to create logger, %s", err)
+	}
+
+	server, err := CreateSMTPServer(ctx, &Configuration{Listeners: listeners}, logger)
+	if err != nil {
+		t.Fatalf("Failed to create server, %s", err)
+	}
+
+	go server.WaitForConnections()
+
+	t.Cleanup(func() {
+		select {
+		case <-server.quitChannel:
+		default:
+			server.Shutdown(5 * time.Second)
+		}
+		_ = logger.Close()
+	})
+
+	testDatabases.lock.Lock()
+	database := testDatabases.databases[dataSourceName]
+	testDatabases.lock.Unlock()
+
+	return server, database
+}
+
+func createTestListener(name string) *ListenerConfiguration {
+	return &ListenerConfiguration{
+		BannerHost:          "mx.example.com",
+		BannerName:          "smtplog",
+		ConnectionTimeLimit: 30,
+		ListenAddress:       "127.0.0.1:0",
+		ListenNetwork:       "tcp",
+		Name:                name,
+		ReadTimeout:         5,
+	}
+}
+
+// createTestTLSConfig returns a server configuration using a new self-signed certificate.
+func createTestTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+
+	certPEM, keyPEM, err := GenerateCertificate([]string{"mx.example.com"}, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to generate certificate, %s", err)
+	}
+
+	certificate, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("Failed to load certificate, %s", err)
+	}
+
+	return &tls.Config{Certificates: []tls.Certificate{certificate}}
+}
+
+// dialTestServer connects to the first listener of the server and reads the banner.
+func dialTestServer(t *testing.T, server *SMTPServer) (net.Conn, *bufio.Reader) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", server.listeners[0].listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect, %s", err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	reader := bufio.NewReader(conn)
+	expectReply(t, reader, "220 ")
+
+	return conn, reader
+}
+
+// testPipeConn is the server end of a net.Pipe, which reports a TCP remote address so it
+// can be handled like a client connection.
+type testPipeConn struct {
+	net.Conn
+}
+
+func (testPipeConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 25025}
+}
+
+// dialTestPipe connects to the first listener of the server through a net.Pipe and reads
+// the banner. Every read of the pipe returns at most what one write of the server sent.
+func dialTestPipe(t *testing.T, server *SMTPServer) (net.Conn, *bufio.Reader) {
+	t.Helper()
+
+	conn, serverConn := net.Pipe()
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	server.waitGroup.Add(1)
+	go server.handleConnection(server.listeners[0], testPipeConn{serverConn})
+
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	reader := bufio.NewReader(conn)
+	expectReply(t, reader, "220 ")
+
+	return conn, reader
+}
+
+// readReply reads one reply, joining the lines of a multiline reply.
+func readReply(t *testing.T, reader *bufio.Reader) string {
+	t.Helper()
+
+	var lines []string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Failed to read reply after %q, %s", lines, err)
+		}
+		lines = append(lines, line)
+
+		if len(line) < 4 || line[3] != '-' {
+			return strings.Join(lines, "")
+		}
+	}
+}
+
+// expectReply reads one reply and fails unless its last line starts with the prefix.
+func expectReply(t *testing.T, reader *bufio.Reader, prefix string) string {
+	t.Helper()
+
+	reply := readReply(t, reader)
+
+	lines := strings.Split(strings.TrimSuffix(reply, "\r\n"), "\r\n")
+	if !strings.HasPrefix(lines[len(lines)-1], prefix) {
+		t.Fatalf("Expected reply starting with %q, got %q", prefix, reply)
+	}
+
+	return reply
+}
+
+// startTestTLS completes the client side of the handshake once STARTTLS was accepted.
+func startTestTLS(t *testing.T, conn net.Conn) (net.Conn, *bufio.Reader) {
+	t.Helper()
+
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true, ServerName: "mx.example.com"})
+
+	err := tlsConn.Handshake()
+	if err != nil {
+		t.Fatalf("Failed TLS handshake, %s", err)
+	}
+
+	return tlsConn, bufio.NewReader(tlsConn)
+}
+
+func writeTestInput(t *testing.T, conn net.Conn, input string) {
+	t.Helper()
+
+	_, err := conn.Write([]byte(input))
+	if err != nil {
+		t.Fatalf("Failed to write %q, %s", input, err)
+	}
+}
+
+func TestPipelinedTransactionInOneWrite(t *testing.T) {
+	server, database := startTestServer(t, context.Background(), createTestListener("pipelining"))
+	conn, reader := dialTestPipe(t, server)
+
+	writeTestInput(t, conn, "EHLO client.example.com\r\n")
+	expectReply(t, reader, "250 ")
+
+	writeTestInput(t, conn, "MAIL FROM:<sender@example.com>\r\n"+
+		"RCPT TO:<first@example.com>\r\n"+
+		"RCPT TO:<second@example.com>\r\n"+
+		"DATA\r\n"+
+		"Subject: pipelined\r\n"+
+		"\r\n"+
+		"Hello\r\n"+
+		".\r\n"+
+		"QUIT\r\n")
+
+	// The replies up to DATA are sent in one write, as the commands were already received.
+	batch := make([]byte, 4096)
+	size, err := reader.Read(batch)
+	if err != nil {
+		t.Fatalf("Failed to read replies, %s", err)
+	}
+
+	expected := "250 2.1.0 OK\r\n250 2.1.5 OK\r\n250 2.1.5 OK\r\n354 "
+	if !strings.HasPrefix(string(batch[:size]), expected) {
+		t.Fatalf("Expected replies starting with %q in one read, got %q", expected, batch[:size])
+	}
+
+	rest, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Failed to read replies, %s", err)
+	}
+
+	replies := string(batch[:size]) + string(rest)
+	if !strings.HasSuffix(replies, "\r\n250 2.0.0 OK\r\n221 2.0.0 Service closing transmission channel\r\n") {
+		t.Fatalf("Expected message to be accepted before QUIT, got %q", replies)
+	}
+
+	mails := database.find("INSERT INTO mail ")
+	if len(mails) != 1 {
+		t.Fatalf("Expected 1 mail to be logged, got %d", len(mails))
+	}
+	if data := string(mails[0][2].([]byte)); data != "Subject: pipelined\r\n\r\nHello\r\n" {
+		t.Fatalf("Unexpected message data %q", data)
+	}
+
+	if recipients := database.find("INSERT INTO mail_recipient "); len(recipients) != 3 {
+		t.Fatalf("Expected sender and 2 recipients to be logged, got %d", len(recipients))
+	}
+}
+
+func TestSTARTTLSDiscardsPipelinedPlaintext(t *testing.T) {
+	listener := createTestListener("starttls")
+	listener.TLSConfig = createTestTLSConfig(t)
+	listener.TLSMode = TLSModeSTARTTLS
+
+	server, database := startTestServer(t, context.Background(), listener)
+	conn, reader := dialTestServer(t, server)
+
+	writeTestInput(t, conn, "EHLO client.example.com\r\n")
+	expectReply(t, reader, "250 ")
+
+	// A command sent in plaintext behind STARTTLS could have been injected by anyone on
+	// the path, so it must not be run inside the encrypted session.
+	writeTestInput(t, conn, "STARTTLS\r\nMAIL FROM:<injected@example.com>\r\n")
+	expectReply(t, reader, "220 2.0.0 ")
+
+	if reader.Buffered() > 0 {
+		t.Fatalf("Expected no replies before the handshake, got %d bytes", reader.Buffered())
+	}
+
+	tlsConn, tlsReader := startTestTLS(t, conn)
+
+	writeTestInput(t, tlsConn, "EHLO client.example.com\r\nMAIL FROM:<sender@example.com>\r\nQUIT\r\n")
+	expectReply(t, tlsReader, "250 ")
+	expectReply(t, tlsReader, "250 2.1.0 ")
+	expectReply(t, tlsReader, "221 ")
+
+	for _, arguments := range database.find("INSERT INTO connection_messages ") {
+		if strings.Contains(string(arguments[3].([]byte)), "injected@example.com") {
+			t.Fatalf("Expected plaintext sent before the handshake to be discarded, got %q", arguments[3])
+		}
+	}
+}
+
+func TestMessageStoredAsReceivedWithoutTraceHeaders(t *testing.T) {
+	listener := createTestListener("exact")
+	listener.TLSConfig = createTestTLSConfig(t)
+	listener.TLSMode = TLSModeSTARTTLS
+
+	server, database := startTestServer(t, context.Background(), listener)
+	conn, reader := dialTestServer(t, server)
+
+	writeTestInput(t, conn, "EHLO client.example.com\r\n")
+	expectReply(t, reader, "250 ")
+
+	writeTestInput(t, conn, "STARTTLS\r\n")
+	expectReply(t, reader, "220 2.0.0 ")
+
+	tlsConn, tlsReader := startTestTLS(t, conn)
+
+	body := "Subject: exact \r\n\r\nbare\nline\r\n\ttrailing \r\n"
+
+	writeTestInput(t, tlsConn, "EHLO client.example.com\r\n")
+	expectReply(t, tlsReader, "250 ")
+	writeTestInput(t, tlsConn, "MAIL FROM:<sender@example.com>\r\n")
+	expectReply(t, tlsReader, "250 ")
+	writeTestInput(t, tlsConn, "RCPT TO:<recipient@example.com>\r\n")
+	expectReply(t, tlsReader, "250 ")
+	writeTestInput(t, tlsConn, "DATA\r\n")
+	expectReply(t, tlsReader, "354 ")
+	writeTestInput(t, tlsConn, body+".\r\nQUIT\r\n")
+	expectReply(t, tlsReader, "250 2.0.0 ")
+	expectReply(t, tlsReader, "221 ")
+
+	mails := database.find("INSERT INTO mail ")
+	if len(mails) != 1 {
+		t.Fatalf("Expected 1 mail to be logged, got %d", len(mails))
+	}
+	if data := string(mails[0][2].([]byte)); data != body {
+		t.Fatalf("Expected message to be stored as received, got %q", data)
+	}
+
+	// The session details are kept on the connection rather than in the message.
+	var tlsVersion driver.Value
+	for _, arguments := range database.find("UPDATE connections ") {
+		tlsVersion = arguments[8]
+	}
+	if tlsVersion == nil || !strings.HasPrefix(tlsVersion.(string), "TLS") {
+		t.Fatalf("Expected TLS version to be recorded on the connection, got %v", tlsVersion)
+	}
+}
+
+func TestDATAEndsOnBareLFDotLine(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		data      string
+		hasBareLF bool
+	}{
+		{"bare LF throughout", "Subject: x\nbody\n.\n", "Subject: x\nbody\n", true},
+		{"bare LF terminator", "Subject: x\r\n\r\nbody\r\n.\n", "Subject: x\r\n\r\nbody\r\n", true},
+		{"bare LF before terminator", "Subject: x\r\n\r\nbody\n.\r\n", "Subject: x\r\n\r\nbody\n", true},
+		{"CRLF throughout", "Subject: x\r\n\r\n..body\r\n.\r\n", "Subject: x\r\n\r\n.body\r\n", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, database := startTestServer(t, context.Background(), createTestListener("bare-lf"))
+			conn, reader := dialTestServer(t, server)
+
+			writeTestInput(t, conn, "HELO client.example.com\r\nMAIL FROM:<sender@example.com>\r\nRCPT TO:<recipient@example.com>\r\nDATA\r\n")
+			expectReply(t, reader, "250 ")
+			expectReply(t, reader, "250 ")
+			expectReply(t, reader, "250 ")
+			expectReply(t, reader, "354 ")
+
+			// The session must carry on straight after the terminator, not time out.
+			writeTestInput(t, conn, test.input+"QUIT\r\n")
+			expectReply(t, reader, "250 ")
+			expectReply(t, reader, "221 ")
+
+			mails := database.find("INSERT INTO mail ")
+			if len(mails) != 1 {
+				t.Fatalf("Expected 1 mail to be logged, got %d", len(mails))
+			}
+			if data := string(mails[0][2].([]byte)); data != test.data {
+				t.Errorf("Expected message data %q, got %q", test.data, data)
+			}
+			if hasBareLF := mails[0][3].(bool); hasBareLF != test.hasBareLF {
+				t.Errorf("Expected has_bare_lf to be %t, got %t", test.hasBareLF, hasBareLF)
+			}
+		})
+	}
+}
+
+func TestBDATLimitedByMaxMessageSizeOnly(t *testing.T) {
+	listener := createTestListener("bdat")
+	listener.MaxMessageSize = 10
+
+	server, database := startTestServer(t, context.Background(), listener)
+	conn, reader := dialTestServer(t, server)
+
+	writeTestInput(t, conn, "EHLO client.example.com\r\n")
+	expectReply(t, reader, "250 ")
+
+	// The declared SIZE is only an estimate, so a larger message is still accepted.
+	writeTestInput(t, conn, "MAIL FROM:<sender@example.com> SIZE=3\r\nRCPT TO:<recipient@example.com>\r\n")
+	expectReply(t, reader, "250 ")
+	expectReply(t, reader, "250 ")
+	writeTestInput(t, conn, "BDAT 5 LAST\r\nhello")
+	expectReply(t, reader, "250 2.0.0 ")
+
+	writeTestInput(t, conn, "MAIL FROM:<sender@example.com>\r\nRCPT TO:<recipient@example.com>\r\n")
+	expectReply(t, reader, "250 ")
+	expectReply(t, reader, "250 ")
+	writeTestInput(t, conn, "BDAT 11 LAST\r\nhello world")
+	expectReply(t, reader, "552 ")
+
+	if mails := database.find("INSERT INTO mail "); len(mails) != 1 {
+		t.Fatalf("Expected 1 mail to be logged, got %d", len(mails))
+	}
+}
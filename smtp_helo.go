@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// reverseLookupTimeout limits how long a HELO waits for the client's reverse DNS.
+const reverseLookupTimeout = 5 * time.Second
+
+// Resolver looks up the host names of an address. It is read from the context so tests
+// can replace net.DefaultResolver.
+type Resolver interface {
+	LookupAddr(ctx context.Context, address string) ([]string, error)
+}
+
+// setHeloName records the host name the client claimed in HELO, EHLO or LHLO and checks
+// it against the reverse DNS of the connecting address. A name forwarded with XCLIENT
+// belongs to the original client and is kept.
+func (n *SMTPConnection) setHeloName(name string) {
+	if n.isHeloForwarded {
+		return
+	}
+
+	n.record.HeloName = name
+	n.lookupReverseNames()
+	n.record.IsHeloVerified = isHeloVerified(name, n.record.RemoteAddress, n.reverseNames)
+
+	verified := "does not match"
+	if n.record.IsHeloVerified {
+		verified = "matches"
+	}
+
+	reverseName := n.record.ReverseName
+	if reverseName == "" {
+		reverseName = "unknown"
+	}
+
+	log.Printf("HELO %s from %s %s reverse DNS %s", name, n.record, verified, reverseName)
+	n.updateConnection()
+}
+
+// lookupReverseNames resolves the reverse DNS of the remote address once per address,
+// recording the first name found. A name forwarded with XCLIENT is used as is.
+func (n *SMTPConnection) lookupReverseNames() {
+	if n.isReverseNameForwarded {
+		n.reverseNames = nil
+		if n.record.ReverseName != "" {
+			n.reverseNames = []string{n.record.ReverseName}
+		}
+		return
+	}
+
+	if n.record.RemoteAddress == "" || n.reverseLookupAddress == n.record.RemoteAddress {
+		return
+	}
+	n.reverseLookupAddress = n.record.RemoteAddress
+	n.reverseNames = nil
+
+	ctx, cancel := context.WithTimeout(n.context, reverseLookupTimeout)
+	defer cancel()
+
+	names, err := n.context.Value(smtpContextKey("resolver")).(Resolver).LookupAddr(ctx, n.record.RemoteAddress)
+	var dnsErr *net.DNSError
+	if err != nil && !(errors.As(err, &dnsErr) && dnsErr.IsNotFound) {
+		log.Printf("Failed to look up reverse DNS of %s, %s", n.record.RemoteAddress, err)
+	}
+
+	for _, name := range names {
+		n.reverseNames = append(n.reverseNames, strings.TrimSuffix(name, "."))
+	}
+
+	n.record.ReverseName = ""
+	if len(n.reverseNames) > 0 {
+		n.record.ReverseName = n.reverseNames[0]
+	}
+}
+
+// isHeloVerified returns whether the HELO name is the reverse DNS name of the client, or
+// an address literal of the address it connected from.
+func isHeloVerified(name string, remoteAddress string, reverseNames []string) bool {
+	if name == "" {
+		return false
+	}
+
+	if isAddressLiteral(name) {
+		ip := parseAddressLiteral(name)
+		return ip != nil && ip.Equal(net.ParseIP(remoteAddress))
+	}
+
+	for _, reverseName := range reverseNames {
+		if strings.EqualFold(strings.TrimSuffix(name, "."), reverseName) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isAddressLiteral(name string) bool {
+	return strings.HasPrefix(name, "[") && strings.HasSuffix(name, "]")
+}
+
+// parseAddressLiteral returns the address of an address literal such as [192.0.2.1] or
+// [IPv6:2001:db8::1], or nil if it is not a valid one.
+func parseAddressLiteral(name string) net.IP {
+	if !isAddressLiteral(name) {
+		return nil
+	}
+
+	return net.ParseIP(strings.TrimPrefix(strings.ToUpper(name[1:len(name)-1]), "IPV6:"))
+}
+
+// isHostname returns whether the name is a syntactically valid host name. Underscores are
+// accepted, as plenty of clients use them in the names they send.
+func isHostname(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" || len(name) > 253 {
+		return false
+	}
+
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+
+		for _, char := range label {
+			isAlphanumeric := (char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z') || (char >= '0' && char <= '9')
+			if !isAlphanumeric && char != '-' && char != '_' {
+				return false
+			}
+		}
+	}
+
+	return true
+}
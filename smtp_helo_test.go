@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+// testResolver answers reverse lookups from a fixed table instead of DNS.
+type testResolver map[string][]string
+
+func (n testResolver) LookupAddr(_ context.Context, address string) ([]string, error) {
+	names, exists := n[address]
+	if !exists {
+		return nil, &net.DNSError{Err: "no such host", Name: address, IsNotFound: true}
+	}
+
+	return names, nil
+}
+
+func TestIsHeloVerified(t *testing.T) {
+	tests := []struct {
+		name          string
+		helo          string
+		remoteAddress string
+		reverseNames  []string
+		expected      bool
+	}{
+		{"reverse name", "mail.example.com", "192.0.2.1", []string{"mail.example.com"}, true},
+		{"reverse name case", "MAIL.example.com.", "192.0.2.1", []string{"mail.example.com"}, true},
+		{"second reverse name", "mx.example.com", "192.0.2.1", []string{"mail.example.com", "mx.example.com"}, true},
+		{"other name", "spoofed.example.com", "192.0.2.1", []string{"mail.example.com"}, false},
+		{"no reverse names", "mail.example.com", "192.0.2.1", nil, false},
+		{"empty name", "", "192.0.2.1", []string{""}, false},
+		{"address literal", "[192.0.2.1]", "192.0.2.1", nil, true},
+		{"other address literal", "[192.0.2.2]", "192.0.2.1", nil, false},
+		{"ipv6 literal", "[IPv6:2001:db8::1]", "2001:db8::1", nil, true},
+		{"ipv6 literal expanded", "[ipv6:2001:DB8:0:0:0:0:0:1]", "2001:db8::1", nil, true},
+		{"invalid literal", "[not-an-address]", "192.0.2.1", nil, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual := isHeloVerified(test.helo, test.remoteAddress, test.reverseNames)
+			if actual != test.expected {
+				t.Errorf("Expected %t for %s from %s, got %t", test.expected, test.helo, test.remoteAddress, actual)
+			}
+		})
+	}
+}
+
+func TestSetHeloName(t *testing.T) {
+	resolver := testResolver{
+		"127.0.0.1": {"client.example.com."},
+	}
+	ctx := context.WithValue(context.Background(), smtpContextKey("resolver"), Resolver(resolver))
+
+	tests := []struct {
+		name        string
+		command     string
+		reverseName string
+		verified    bool
+	}{
+		{"matching name", "EHLO client.example.com\r\n", "client.example.com", true},
+		{"other name", "HELO spoofed.example.com\r\n", "client.example.com", false},
+		{"address literal", "EHLO [127.0.0.1]\r\n", "client.example.com", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, database := startTestServer(t, ctx, createTestListener("helo"))
+			conn, reader := dialTestServer(t, server)
+
+			writeTestInput(t, conn, test.command)
+			expectReply(t, reader, "250 ")
+
+			updates := database.find("UPDATE connections ")
+			if len(updates) == 0 {
+				t.Fatalf("Expected connection to be updated after HELO")
+			}
+
+			// The update sets the HELO name, whether it was verified and the reverse name.
+			arguments := updates[len(updates)-1]
+			if verified := arguments[5].(bool); verified != test.verified {
+				t.Errorf("Expected verified to be %t, got %t", test.verified, verified)
+			}
+			if reverseName := arguments[6]; reverseName != test.reverseName {
+				t.Errorf("Expected reverse name %s, got %v", test.reverseName, reverseName)
+			}
+		})
+	}
+}
+
+func TestSetHeloNameWithoutReverseName(t *testing.T) {
+	ctx := context.WithValue(context.Background(), smtpContextKey("resolver"), Resolver(testResolver{}))
+
+	server, database := startTestServer(t, ctx, createTestListener("helo"))
+	conn, reader := dialTestServer(t, server)
+
+	writeTestInput(t, conn, "EHLO client.example.com\r\n")
+	expectReply(t, reader, "250 ")
+
+	updates := database.find("UPDATE connections ")
+	if len(updates) == 0 {
+		t.Fatalf("Expected connection to be updated after HELO")
+	}
+
+	arguments := updates[len(updates)-1]
+	if arguments[4] != "client.example.com" || arguments[5] != false || arguments[6] != nil {
+		t.Errorf("Expected unverified HELO without reverse name, got %v", arguments[4:7])
+	}
+}
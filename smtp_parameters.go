@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var errUnsupportedParameter = fmt.Errorf("unsupported parameter")
+
+type mailParameterHandler func(message *SMTPMessage, value string) error
+
+type recipientParameterHandler func(recipient *SMTPRecipient, value string) error
+
+var mailParameterHandlers = map[string]mailParameterHandler{
+	"AUTH":     handleMailAUTH,
+	"BODY":     handleMailBODY,
+	"ENVID":    handleMailENVID,
+	"RET":      handleMailRET,
+	"SIZE":     handleMailSIZE,
+	"SMTPUTF8": handleMailSMTPUTF8,
+}
+
+var recipientParameterHandlers = map[string]recipientParameterHandler{
+	"NOTIFY": handleRecipientNOTIFY,
+	"ORCPT":  handleRecipientORCPT,
+}
+
+// parseESMTPParameters splits the keyword[=value] parameters following the address of a
+// MAIL or RCPT command. Keywords are case-insensitive and returned upper-cased, values are
+// returned xtext-decoded.
+func parseESMTPParameters(arguments string) (map[string]string, error) {
+	parameters := map[string]string{}
+
+	for _, parameter := range strings.Fields(arguments) {
+		parts := strings.SplitN(parameter, "=", 2)
+		if len(parts) == 1 {
+			parts = append(parts, "")
+		}
+
+		keyword, value := strings.ToUpper(parts[0]), parts[1]
+		if len(keyword) == 0 {
+			return nil, fmt.Errorf("invalid parameter %s", parameter)
+		}
+		if _, exists := parameters[keyword]; exists {
+			return nil, fmt.Errorf("duplicate parameter %s", keyword)
+		}
+
+		value, err := decodeXtext(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s value, %w", keyword, err)
+		}
+
+		parameters[keyword] = value
+	}
+
+	return parameters, nil
+}
+
+func applyMailParameters(message *SMTPMessage, parameters map[string]string) error {
+	for keyword, value := range parameters {
+		handler := mailParameterHandlers[keyword]
+		if handler == nil {
+			return fmt.Errorf("%w %s", errUnsupportedParameter, keyword)
+		}
+
+		err := handler(message, value)
+		if err != nil {
+			return err
+		}
+	}
+
+	message.parameters = parameters
+	return nil
+}
+
+func applyRecipientParameters(recipient *SMTPRecipient, parameters map[string]string) error {
+	for keyword, value := range parameters {
+		handler := recipientParameterHandlers[keyword]
+		if handler == nil {
+			return fmt.Errorf("%w %s", errUnsupportedParameter, keyword)
+		}
+
+		err := handler(recipient, value)
+		if err != nil {
+			return err
+		}
+	}
+
+	recipient.parameters = parameters
+	return nil
+}
+
+func handleMailAUTH(_ *SMTPMessage, value string) error {
+	if len(value) == 0 {
+		return fmt.Errorf("invalid AUTH, expected mailbox or <>")
+	}
+
+	return nil
+}
+
+func handleMailBODY(message *SMTPMessage, value string) error {
+	value = strings.ToUpper(value)
+	if value != "7BIT" && value != "8BITMIME" && value != "BINARYMIME" {
+		return fmt.Errorf("invalid BODY, expected 7BIT, 8BITMIME or BINARYMIME")
+	}
+
+	message.bodyType = value
+	return nil
+}
+
+func handleMailENVID(message *SMTPMessage, value string) error {
+	if len(value) == 0 || len(value) > 100 {
+		return fmt.Errorf("invalid ENVID")
+	}
+
+	message.dsnEnvelopeID = value
+	return nil
+}
+
+func handleMailRET(message *SMTPMessage, value string) error {
+	value = strings.ToUpper(value)
+	if value != "FULL" && value != "HDRS" {
+		return fmt.Errorf("invalid RET, expected FULL or HDRS")
+	}
+
+	message.dsnReturn = value
+	return nil
+}
+
+func handleMailSIZE(message *SMTPMessage, value string) error {
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 0 {
+		return fmt.Errorf("invalid SIZE, expected number of octets")
+	}
+
+	message.declaredSize = size
+	return nil
+}
+
+func handleMailSMTPUTF8(_ *SMTPMessage, value string) error {
+	if len(value) != 0 {
+		return fmt.Errorf("invalid SMTPUTF8, no value expected")
+	}
+
+	return nil
+}
+
+func handleRecipientNOTIFY(recipient *SMTPRecipient, value string) error {
+	conditions := strings.Split(strings.ToUpper(value), ",")
+
+	for _, condition := range conditions {
+		switch condition {
+		case "NEVER":
+			if len(conditions) > 1 {
+				return fmt.Errorf("invalid NOTIFY, NEVER cannot be combined")
+			}
+		case "SUCCESS", "FAILURE", "DELAY":
+		default:
+			return fmt.Errorf("invalid NOTIFY condition %s", condition)
+		}
+	}
+
+	recipient.dsnNotify = strings.Join(conditions, ",")
+	return nil
+}
+
+func handleRecipientORCPT(recipient *SMTPRecipient, value string) error {
+	parts := strings.SplitN(value, ";", 2)
+	if len(parts) != 2 || len(parts[0]) == 0 || len(value) > 500 {
+		return fmt.Errorf("invalid ORCPT, expected addr-type;address")
+	}
+
+	if len(parts[1]) == 0 {
+		return fmt.Errorf("invalid ORCPT address")
+	}
+
+	recipient.dsnOriginalRecipient = fmt.Sprintf("%s;%s", strings.ToLower(parts[0]), parts[1])
+	return nil
+}
+
+// decodeXtext decodes the RFC 3461 xtext encoding, where any character outside printable
+// ASCII, "+" and "=" is sent as "+" followed by two upper-case hex digits.
+func decodeXtext(value string) (string, error) {
+	var decoded strings.Builder
+
+	for i := 0; i < len(value); i++ {
+		char := value[i]
+
+		switch {
+		case char == '+':
+			if i+2 >= len(value) || !isUpperHex(value[i+1]) || !isUpperHex(value[i+2]) {
+				return "", fmt.Errorf("invalid xtext hex sequence at %d", i)
+			}
+			decoded.WriteByte(unhex(value[i+1])<<4 | unhex(value[i+2]))
+			i += 2
+		case char < 33 || char > 126 || char == '=':
+			return "", fmt.Errorf("invalid xtext character at %d", i)
+		default:
+			decoded.WriteByte(char)
+		}
+	}
+
+	return decoded.String(), nil
+}
+
+func isUpperHex(char byte) bool {
+	return (char >= '0' && char <= '9') || (char >= 'A' && char <= 'F')
+}
+
+func unhex(char byte) byte {
+	if char >= 'A' {
+		return char - 'A' + 10
+	}
+	return char - '0'
+}
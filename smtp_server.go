@@ -3,22 +3,69 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"net/textproto"
+	"os"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
+
+	"github.com/oklog/ulid/v2"
 )
 
 type smtpContextKey string
 
+// forcedCloseTimeout is how long connections have to clean up after being forced closed.
+const forcedCloseTimeout = 5 * time.Second
+
 type SMTPServer struct {
-	connections []*SMTPConnection
-	context     context.Context
-	listener    net.Listener
-	quitChannel chan interface{}
-	waitGroup   sync.WaitGroup
+	config         *Configuration
+	connections    *ConnectionRegistry
+	context        context.Context
+	listeners      []*SMTPListener
+	metrics        *Metrics
+	metricsAddress string
+	metricsServer  *http.Server
+	pauseLock      sync.Mutex
+	quitChannel    chan interface{}
+	rateLimiter    *RateLimiter
+	resumeChannel  chan interface{}
+	waitGroup      sync.WaitGroup
+}
+
+type SMTPListener struct {
+	config     *ListenerConfiguration
+	configLock sync.RWMutex
+	context    context.Context
+	listener   net.Listener
+	name       string
+}
+
+// snapshot returns the settings new connections on this listener should use. They are
+// read together so a reload cannot hand a connection a mix of old and new settings.
+func (n *SMTPListener) snapshot() (*ListenerConfiguration, context.Context) {
+	n.configLock.RLock()
+	defer n.configLock.RUnlock()
+
+	return n.config, n.context
+}
+
+func (n *SMTPListener) snapshotConfig() *ListenerConfiguration {
+	config, _ := n.snapshot()
+	return config
+}
+
+func (n *SMTPListener) setConfig(config *ListenerConfiguration, ctx context.Context) {
+	n.configLock.Lock()
+	defer n.configLock.Unlock()
+
+	n.config = config
+	n.context = ctx
 }
 
 func CreateSMTPServer(
@@ -26,55 +73,179 @@ func CreateSMTPServer(
 	config *Configuration,
 	logger *DatabaseLogger,
 ) (server *SMTPServer, err error) {
-	listenAddress := fmt.Sprintf("%s:%d", config.ListenHost, config.ListenPort)
+	metrics := CreateMetrics()
+	rateLimiter := CreateRateLimiter(config.RateLimits)
 
-	ctx = context.WithValue(ctx, smtpContextKey("bannerHost"), config.BannerHost)
-	ctx = context.WithValue(ctx, smtpContextKey("bannerName"), config.BannerName)
-	ctx = context.WithValue(ctx, smtpContextKey("connectionTimeLimit"), config.ConnectionTimeLimit)
 	ctx = context.WithValue(ctx, smtpContextKey("logger"), logger)
-	ctx = context.WithValue(ctx, smtpContextKey("readTimeout"), config.ReadTimeout)
-	ctx = context.WithValue(ctx, smtpContextKey("tlsConfig"), config.TLSConfig)
+	ctx = context.WithValue(ctx, smtpContextKey("metrics"), metrics)
+	ctx = context.WithValue(ctx, smtpContextKey("rateLimiter"), rateLimiter)
 
-	listener, err := createListener(config.ListenHost, config.ListenPort, config.IsTLS, config.TLSConfig)
-	if err != nil {
-		return nil, err
+	if _, exists := ctx.Value(smtpContextKey("resolver")).(Resolver); !exists {
+		ctx = context.WithValue(ctx, smtpContextKey("resolver"), Resolver(net.DefaultResolver))
 	}
 
-	log.Printf("Started listening on %s", listenAddress)
 	server = &SMTPServer{
+		config:      config,
+		connections: CreateConnectionRegistry(config.MaxConnections, config.MaxConnectionsPerIP),
 		context:     ctx,
-		listener:    listener,
+		metrics:     metrics,
 		quitChannel: make(chan interface{}),
+		rateLimiter: rateLimiter,
+	}
+
+	inherited, err := inheritListeners()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, listenerConfig := range config.Listeners {
+		var listener net.Listener
+		listener, inherited = takeInheritedListener(inherited, listenerConfig)
+		if listener != nil {
+			log.Printf("Inherited listener on %s (%s)", listener.Addr(), listenerConfig.Name)
+		} else {
+			listener, err = createListener(listenerConfig)
+			if err != nil {
+				closeInheritedListeners(inherited)
+				server.closeListeners()
+				return nil, fmt.Errorf("failed to listen on %s, %w", listenerConfig.Name, err)
+			}
+
+			log.Printf("Started listening on %s (%s)", listener.Addr(), listenerConfig.Name)
+		}
+
+		metrics.AddListener(listenerConfig.Name)
+
+		server.listeners = append(server.listeners, &SMTPListener{
+			config:   listenerConfig,
+			context:  createListenerContext(ctx, listenerConfig),
+			listener: listener,
+			name:     listenerConfig.Name,
+		})
 	}
 
+	closeInheritedListeners(inherited)
+
 	return server, nil
 }
 
-func createListener(
-	listenHost string,
-	listenPort int,
-	isTLS bool,
-	tlsConfig *tls.Config,
-) (listener net.Listener, err error) {
-	listenAddress := fmt.Sprintf("%s:%d", listenHost, listenPort)
+func createListenerContext(ctx context.Context, config *ListenerConfiguration) context.Context {
+	var tlsConfig *tls.Config
+	if config.TLSMode == TLSModeSTARTTLS {
+		tlsConfig = config.TLSConfig
+	}
+
+	ctx = context.WithValue(ctx, smtpContextKey("authPolicy"), config.AuthPolicy)
+	ctx = context.WithValue(ctx, smtpContextKey("bannerHost"), config.BannerHost)
+	ctx = context.WithValue(ctx, smtpContextKey("bannerName"), config.BannerName)
+	ctx = context.WithValue(ctx, smtpContextKey("connectionTimeLimit"), config.ConnectionTimeLimit)
+	ctx = context.WithValue(ctx, smtpContextKey("isLMTP"), config.IsLMTP)
+	ctx = context.WithValue(ctx, smtpContextKey("listenerName"), config.Name)
+	ctx = context.WithValue(ctx, smtpContextKey("lmtpReplies"), config.LMTPReplies)
+	ctx = context.WithValue(ctx, smtpContextKey("maxErrors"), config.MaxErrors)
+	ctx = context.WithValue(ctx, smtpContextKey("maxLineLength"), config.MaxLineLength)
+	ctx = context.WithValue(ctx, smtpContextKey("maxMessageSize"), config.MaxMessageSize)
+	ctx = context.WithValue(ctx, smtpContextKey("maxRecipients"), config.MaxRecipients)
+	ctx = context.WithValue(ctx, smtpContextKey("readTimeout"), config.ReadTimeout)
+	ctx = context.WithValue(ctx, smtpContextKey("tlsConfig"), tlsConfig)
+	ctx = context.WithValue(ctx, smtpContextKey("traceHeaders"), config.TraceHeaders)
+	ctx = context.WithValue(ctx, smtpContextKey("xclientTrusted"), config.XClientTrusted)
+
+	return ctx
+}
+
+func createListener(config *ListenerConfiguration) (listener net.Listener, err error) {
+	if config.ListenNetwork == "unix" {
+		err = removeStaleSocket(config.ListenAddress)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	if !isTLS {
-		return net.Listen("tcp", listenAddress)
+	return net.Listen(config.ListenNetwork, config.ListenAddress)
+}
+
+// removeStaleSocket removes a socket file left behind by a previous process that did not
+// shut down cleanly, refusing to touch anything that is not a socket. A socket is only
+// stale if connecting to it is refused, as otherwise another process is still serving it.
+func removeStaleSocket(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
 	}
 
-	return tls.Listen("tcp", listenAddress, tlsConfig)
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		_ = conn.Close()
+		return fmt.Errorf("%s is in use by another process", path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return fmt.Errorf("failed to check whether %s is in use, %w", path, err)
+	}
+
+	return os.Remove(path)
 }
 
 func (n *SMTPServer) Stop() {
 	close(n.quitChannel)
 
-	for _, connection := range n.connections {
-		connection.isDisconnecting = true
+	n.connections.Each(func(connection *SMTPConnection) {
+		connection.setDisconnecting()
+		connection.interruptIfIdle()
+	})
+
+	n.closeListeners()
+}
+
+// Shutdown stops accepting connections and waits for the open ones to drain. Sessions
+// waiting for a command are sent 421 at once, while those in the middle of one, such as
+// a message being received, finish it first. Connections still open after the timeout are
+// forced closed and false is returned.
+func (n *SMTPServer) Shutdown(timeout time.Duration) bool {
+	n.Stop()
+
+	if n.waitForCleanup(timeout) {
+		return true
 	}
 
-	err := n.listener.Close()
-	if err != nil {
-		log.Printf("Failed to close listener, %s", err)
+	log.Printf("Forcing connections closed after %s", timeout)
+	n.CloseConnections()
+
+	if !n.waitForCleanup(forcedCloseTimeout) {
+		log.Printf("Failed to clean up connections in time")
+	}
+
+	return false
+}
+
+func (n *SMTPServer) waitForCleanup(timeout time.Duration) bool {
+	done := make(chan interface{})
+	go func() {
+		n.WaitForCleanup()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (n *SMTPServer) closeListeners() {
+	for _, listener := range n.listeners {
+		err := listener.listener.Close()
+		if err != nil {
+			log.Printf("Failed to close listener %s, %s", listener.name, err)
+		}
 	}
 }
 
@@ -88,6 +259,19 @@ func (n *SMTPServer) WaitForConnections() {
 		n.waitGroup.Done()
 	}()
 
+	var listenerGroup sync.WaitGroup
+	for _, listener := range n.listeners {
+		listenerGroup.Add(1)
+		go func(listener *SMTPListener) {
+			defer listenerGroup.Done()
+			n.acceptConnections(listener)
+		}(listener)
+	}
+
+	listenerGroup.Wait()
+}
+
+func (n *SMTPServer) acceptConnections(listener *SMTPListener) {
 listen:
 	for {
 		select {
@@ -96,7 +280,7 @@ listen:
 		case <-n.context.Done():
 			break listen
 		default:
-			conn, err := n.listener.Accept()
+			conn, err := listener.listener.Accept()
 			if err != nil {
 				select {
 				case <-n.quitChannel:
@@ -104,38 +288,107 @@ listen:
 				case <-n.context.Done():
 					break listen
 				default:
-					log.Printf("Failed to accept connection, %s", err)
-					continue listen
 				}
+
+				resume := n.pausedChannel()
+				if resume != nil {
+					select {
+					case <-n.quitChannel:
+						break listen
+					case <-resume:
+						continue listen
+					}
+				}
+
+				log.Printf("Failed to accept connection on %s, %s", listener.name, err)
+				continue listen
 			}
 
-			go n.handleConnection(conn)
+			// The connection is counted before its goroutine starts so a shutdown waiting
+			// on the group cannot miss it.
+			n.waitGroup.Add(1)
+			go n.handleConnection(listener, conn)
 		}
 	}
 }
 
-func (n *SMTPServer) handleConnection(conn net.Conn) {
+func (n *SMTPServer) handleConnection(listener *SMTPListener, conn net.Conn) {
+	defer n.waitGroup.Done()
+
+	rawConnection := conn
 	logger := n.context.Value(smtpContextKey("logger")).(*DatabaseLogger)
-	tcpAddr := conn.RemoteAddr().(*net.TCPAddr)
-	if tcpAddr == nil {
-		log.Printf("Failed to get remote address")
+	config, listenerContext := listener.snapshot()
+
+	proxyAddr := conn.RemoteAddr()
+	isProxied := config.IsProxyProtocol && isTrustedAddress(proxyAddr, config.ProxyTrusted)
+	if isProxied {
+		proxiedConn, err := readProxyHeader(conn, time.Duration(config.ReadTimeout)*time.Second)
+		if err != nil {
+			log.Printf("Failed to read proxy header from %s, %s", proxyAddr, err)
+			_ = conn.Close()
+			return
+		}
+		conn = proxiedConn
+	}
+
+	record, err := createConnectionRecord(listener.name, conn)
+	if err != nil {
+		log.Printf("Failed to get remote address, %s", err)
+		_ = conn.Close()
 		return
 	}
 
-	connectionID, err := logger.LogConnection(
-		tcpAddr.IP.String(),
-		tcpAddr.Port,
-	)
+	if isProxied {
+		proxyTCPAddr := proxyAddr.(*net.TCPAddr)
+		record.ProxyAddress = proxyTCPAddr.IP.String()
+		record.ProxyPort = proxyTCPAddr.Port
+	}
+
+	// The slot is taken before the TLS handshake so connections still negotiating count
+	// towards the limits.
+	limitAddress := record.RemoteAddress
+	limitErr := n.connections.Reserve(limitAddress)
+	if limitErr != nil {
+		n.rejectConnection(listener.name, config, conn, record, limitErr)
+		return
+	}
+	defer n.connections.Release(limitAddress)
+
+	if config.TLSMode == TLSModeImplicit {
+		tlsConn := tls.Server(conn, config.TLSConfig)
+
+		// The handshake is completed up front so the session details are known when the
+		// connection is logged.
+		_ = tlsConn.SetDeadline(time.Now().Add(time.Duration(config.ReadTimeout) * time.Second))
+		err = tlsConn.Handshake()
+		n.metrics.TLSHandshake("implicit", err)
+		if err != nil {
+			log.Printf("Failed TLS handshake with %s, %s", record, err)
+			_ = tlsConn.Close()
+			return
+		}
+		_ = tlsConn.SetDeadline(time.Time{})
+
+		record.TLS = createTLSDetails(tlsConn.ConnectionState())
+		conn = tlsConn
+	}
+
+	connectionULID := strings.ToLower(ulid.Make().String())
+
+	started := time.Now()
+	connectionID, err := logger.LogConnection(connectionULID, record)
+	n.metrics.StoreWrite("connection", time.Since(started), err)
 	if err != nil {
 		log.Printf("Failed to log connection, %s", err)
 		// TODO Return?
 	}
 
-	log.Printf("Accepted connection from %s", conn.RemoteAddr())
+	log.Printf("Accepted connection from %s on %s", record, listener.name)
+	n.metrics.ConnectionAccepted(listener.name)
 
 	ctx, cancel := context.WithTimeout(
-		n.context,
-		time.Duration(n.context.Value(smtpContextKey("connectionTimeLimit")).(int))*time.Second,
+		listenerContext,
+		time.Duration(listenerContext.Value(smtpContextKey("connectionTimeLimit")).(int))*time.Second,
 	)
 
 	textConn := textproto.NewConn(conn)
@@ -145,13 +398,29 @@ func (n *SMTPServer) handleConnection(conn net.Conn) {
 		context:        ctx,
 		cancel:         cancel,
 		connectionID:   connectionID,
+		connectionULID: connectionULID,
 		netConnection:  conn,
+		rawConnection:  rawConnection,
+		record:         record,
 		textConnection: textConn,
 	}
+	connection.responder = &SMTPResponder{
+		connection: &connection,
+		messages:   make([]*SMTPResponse, 0),
+	}
 
-	n.connections = append(n.connections, &connection)
+	n.connections.Add(&connection)
 
-	n.waitGroup.Add(1)
+	// Stop closes the quit channel before it marks the registered connections, so one
+	// registered after that is marked here instead.
+	select {
+	case <-n.quitChannel:
+		connection.setDisconnecting()
+	default:
+	}
+
+	n.metrics.ConnectionOpened(listener.name)
+	defer n.metrics.ConnectionClosed(listener.name)
 
 	connection.SendBanner()
 	connection.WaitForCommands()
@@ -159,39 +428,121 @@ func (n *SMTPServer) handleConnection(conn net.Conn) {
 	n.Close(&connection)
 }
 
+// rejectConnection tells a client over the connection limits to try again later and
+// closes the connection, doing as little work as possible for it. Only implicit TLS
+// listeners complete the handshake, as the client could not read the reply otherwise, and
+// rejections are logged at most once per rejectionLogInterval.
+func (n *SMTPServer) rejectConnection(
+	listenerName string,
+	config *ListenerConfiguration,
+	conn net.Conn,
+	record ConnectionRecord,
+	limitErr error,
+) {
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	n.metrics.ConnectionRejected(listenerName)
+
+	_ = conn.SetDeadline(time.Now().Add(time.Duration(config.ReadTimeout) * time.Second))
+
+	reply := []byte(fmt.Sprintf("421 %s %s\r\n", EnhancedStatusPolicyDeferred, connectionLimitMessage(limitErr)))
+
+	if config.TLSMode == TLSModeImplicit {
+		tlsConn := tls.Server(conn, config.TLSConfig)
+		err := tlsConn.Handshake()
+		n.metrics.TLSHandshake("implicit", err)
+		if err == nil {
+			_, _ = tlsConn.Write(reply)
+		}
+	} else {
+		_, _ = conn.Write(reply)
+	}
+
+	isLogged, unlogged := n.connections.LogRejection(time.Now())
+	if !isLogged {
+		return
+	}
+
+	if unlogged > 0 {
+		log.Printf(
+			"Rejected connection from %s on %s, %s, %d earlier rejections were not logged",
+			record,
+			listenerName,
+			limitErr,
+			unlogged,
+		)
+	} else {
+		log.Printf("Rejected connection from %s on %s, %s", record, listenerName, limitErr)
+	}
+
+	// Rejections that were not logged are counted on this row so none go unrecorded.
+	record.RejectCount = unlogged + 1
+	record.RejectReason = limitErr.Error()
+
+	logger := n.context.Value(smtpContextKey("logger")).(*DatabaseLogger)
+
+	started := time.Now()
+	_, err := logger.LogConnection(strings.ToLower(ulid.Make().String()), record)
+	n.metrics.StoreWrite("connection", time.Since(started), err)
+	if err != nil {
+		log.Printf("Failed to log connection, %s", err)
+	}
+}
+
+func connectionLimitMessage(err error) string {
+	if errors.Is(err, errTooManyAddressConnections) {
+		return "Too many connections from your address, try again later"
+	}
+
+	return "Too many connections, try again later"
+}
+
+// Close closes a connection once its session has ended. It must only be called from the
+// goroutine handling the connection.
 func (n *SMTPServer) Close(connection *SMTPConnection) {
 	connection.cancel()
+	n.connections.Remove(connection)
 
 	err := connection.textConnection.Close()
 	if err != nil {
-		log.Printf(
-			"Failed to close connection %s, %s",
-			connection.netConnection.RemoteAddr(),
-			err,
-		)
+		log.Printf("Failed to close connection %s, %s", connection.record, err)
 	} else {
-		log.Printf(
-			"Closed connection from %s",
-			connection.netConnection.RemoteAddr(),
-		)
+		log.Printf("Closed connection from %s", connection.record)
 	}
-
-	n.connections = removeConnection(n.connections, connection)
-	n.waitGroup.Done()
 }
 
+// CloseConnections forces every open connection closed. The goroutine handling each one
+// sees its reads fail and finishes the session.
 func (n *SMTPServer) CloseConnections() {
-	for _, connection := range n.connections {
-		n.Close(connection)
-	}
+	n.connections.Each(func(connection *SMTPConnection) {
+		connection.setDisconnecting()
+		connection.cancel()
+		_ = connection.rawConnection.Close()
+	})
 }
 
-func removeConnection(connections []*SMTPConnection, remove *SMTPConnection) []*SMTPConnection {
-	var filtered []*SMTPConnection
-	for _, connection := range connections {
-		if connection.netConnection != remove.netConnection {
-			filtered = append(filtered, connection)
+func createConnectionRecord(listenerName string, conn net.Conn) (ConnectionRecord, error) {
+	record := ConnectionRecord{
+		ListenerName: listenerName,
+	}
+
+	switch remoteAddr := conn.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		record.RemoteAddress = remoteAddr.IP.String()
+		record.RemotePort = remoteAddr.Port
+	case *net.UnixAddr:
+		// The connection is still accepted without credentials, as they only identify the
+		// client in the log.
+		credentials, err := getPeerCredentials(conn)
+		if err != nil {
+			log.Printf("Failed to get peer credentials on %s, %s", listenerName, err)
 		}
+		record.PeerCredentials = credentials
+	default:
+		return record, fmt.Errorf("unsupported remote address %s", conn.RemoteAddr())
 	}
-	return filtered
+
+	return record, nil
 }
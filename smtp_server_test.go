@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRemoveStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "smtp.sock")
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Failed to listen on %s, %s", path, err)
+	}
+
+	err = removeStaleSocket(path)
+	if err == nil {
+		t.Fatalf("Expected a socket in use to be kept")
+	}
+
+	_, err = os.Stat(path)
+	if err != nil {
+		t.Fatalf("Expected a socket in use to be kept, %s", err)
+	}
+
+	// Closing without unlinking leaves the file behind, as a process that crashed would.
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = listener.Close()
+
+	err = removeStaleSocket(path)
+	if err != nil {
+		t.Fatalf("Failed to remove stale socket, %s", err)
+	}
+
+	_, err = os.Stat(path)
+	if !os.IsNotExist(err) {
+		t.Fatalf("Expected stale socket to be removed, %v", err)
+	}
+}
+
+func TestRemoveStaleSocketKeepsOtherFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "smtp.sock")
+
+	err := os.WriteFile(path, []byte("data"), 0o600)
+	if err != nil {
+		t.Fatalf("Failed to write %s, %s", path, err)
+	}
+
+	err = removeStaleSocket(path)
+	if err == nil {
+		t.Fatalf("Expected a file that is not a socket to be kept")
+	}
+}
+
+// listenTestNotifySocket points NOTIFY_SOCKET at a new socket and returns a function that
+// reads the next notification sent to it.
+func listenTestNotifySocket(t *testing.T) func() string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "notify.sock")
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("Failed to listen on %s, %s", path, err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	t.Setenv("NOTIFY_SOCKET", path)
+
+	return func() string {
+		t.Helper()
+
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+
+		buffer := make([]byte, 64)
+		size, err := conn.Read(buffer)
+		if err != nil {
+			t.Fatalf("Failed to read notification, %s", err)
+		}
+
+		return string(buffer[:size])
+	}
+}
+
+func TestNotifySystemd(t *testing.T) {
+	readNotification := listenTestNotifySocket(t)
+
+	err := notifySystemd("MAINPID=1234")
+	if err != nil {
+		t.Fatalf("Failed to notify, %s", err)
+	}
+
+	if state := readNotification(); state != "MAINPID=1234" {
+		t.Fatalf("Expected MAINPID=1234, got %q", state)
+	}
+}
+
+func TestNotifyReady(t *testing.T) {
+	readNotification := listenTestNotifySocket(t)
+	t.Setenv("SMTPLOG_READY_FD", "")
+
+	NotifyReady()
+
+	if state := readNotification(); state != "READY=1" {
+		t.Fatalf("Expected READY=1, got %q", state)
+	}
+}
+
+func TestNotifyHandedOff(t *testing.T) {
+	readNotification := listenTestNotifySocket(t)
+
+	err := notifyHandedOff(1234)
+	if err != nil {
+		t.Fatalf("Failed to notify, %s", err)
+	}
+
+	if state := readNotification(); state != "MAINPID=1234\nREADY=1" {
+		t.Fatalf("Expected MAINPID=1234 and READY=1, got %q", state)
+	}
+}
+
+func TestConcurrentClientsAndShutdown(t *testing.T) {
+	const clients = 200
+
+	server, database := startTestServer(t, context.Background(), createTestListener("concurrent"))
+	address := server.listeners[0].listener.Addr().String()
+
+	// Each client sends a message and then waits, so the shutdown finds every session idle.
+	var delivered sync.WaitGroup
+	var finished sync.WaitGroup
+	errs := make(chan error, clients)
+
+	for i := 0; i < clients; i++ {
+		delivered.Add(1)
+		finished.Add(1)
+
+		go func(i int) {
+			defer finished.Done()
+
+			err := runConcurrentClient(address, i, delivered.Done)
+			if err != nil {
+				errs <- fmt.Errorf("client %d, %w", i, err)
+			}
+		}(i)
+	}
+
+	// Scrapes and reloads run alongside the sessions, as they would in production.
+	stopScraping := make(chan interface{})
+	var scraping sync.WaitGroup
+	scraping.Add(1)
+	go func() {
+		defer scraping.Done()
+
+		for {
+			select {
+			case <-stopScraping:
+				return
+			default:
+				server.metrics.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics", nil))
+
+				err := server.Reload(&Configuration{Listeners: []*ListenerConfiguration{createTestListener("concurrent")}})
+				if err != nil {
+					errs <- fmt.Errorf("reload, %w", err)
+					return
+				}
+			}
+		}
+	}()
+
+	delivered.Wait()
+	close(stopScraping)
+	scraping.Wait()
+
+	if !server.Shutdown(10 * time.Second) {
+		t.Errorf("Expected every connection to drain before the timeout")
+	}
+
+	finished.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if mails := database.find("INSERT INTO mail "); len(mails) != clients {
+		t.Errorf("Expected %d mails to be logged, got %d", clients, len(mails))
+	}
+}
+
+// runConcurrentClient sends one message, calls delivered, then expects the 421 sent to
+// idle sessions when the server shuts down.
+func runConcurrentClient(address string, i int, delivered func()) error {
+	isDelivered := false
+	defer func() {
+		if !isDelivered {
+			delivered()
+		}
+	}()
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	_ = conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	reader := bufio.NewReader(conn)
+
+	expect := func(prefix string) error {
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return fmt.Errorf("expected %q, %w", prefix, err)
+			}
+			if len(line) >= 4 && line[3] == '-' {
+				continue
+			}
+			if !strings.HasPrefix(line, prefix) {
+				return fmt.Errorf("expected %q, got %q", prefix, line)
+			}
+			return nil
+		}
+	}
+
+	err = expect("220 ")
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(
+		conn,
+		"EHLO client%d.example.com\r\nMAIL FROM:<sender%d@example.com>\r\nRCPT TO:<recipient@example.com>\r\nDATA\r\n",
+		i,
+		i,
+	)
+	if err != nil {
+		return err
+	}
+
+	for _, prefix := range []string{"250 ", "250 ", "250 ", "354 "} {
+		err = expect(prefix)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = fmt.Fprintf(conn, "Subject: client %d\r\n\r\nHello\r\n.\r\n", i)
+	if err != nil {
+		return err
+	}
+
+	err = expect("250 ")
+	if err != nil {
+		return err
+	}
+
+	isDelivered = true
+	delivered()
+
+	return expect("421 ")
+}
+
+func TestConnectionAcceptedDuringStopIsClosed(t *testing.T) {
+	server, _ := startTestServer(t, context.Background(), createTestListener("stopping"))
+
+	// A connection accepted just before Stop registers after the open ones were marked.
+	server.Stop()
+
+	conn, reader := dialTestPipe(t, server)
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	expectReply(t, reader, "421 ")
+}
+
+func TestConnectionsOverLimitAreRejected(t *testing.T) {
+	plain := createTestListener("plain")
+	implicit := createTestListener("implicit")
+	implicit.TLSConfig = createTestTLSConfig(t)
+	implicit.TLSMode = TLSModeImplicit
+
+	server, database := startTestServer(t, context.Background(), plain, implicit)
+	server.connections.SetLimits(1, 0)
+
+	dialTestServer(t, server)
+
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", server.listeners[0].listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to connect, %s", err)
+		}
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		// The reply comes straight away, without a banner.
+		reader := bufio.NewReader(conn)
+		expectReply(t, reader, "421 4.7.0 Too many connections")
+		expectClosed(t, reader)
+		_ = conn.Close()
+	}
+
+	tlsConn, err := tls.Dial(
+		"tcp",
+		server.listeners[1].listener.Addr().String(),
+		&tls.Config{InsecureSkipVerify: true, ServerName: "mx.example.com"},
+	)
+	if err != nil {
+		t.Fatalf("Failed TLS handshake, %s", err)
+	}
+	_ = tlsConn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	tlsReader := bufio.NewReader(tlsConn)
+	expectReply(t, tlsReader, "421 4.7.0 Too many connections")
+	expectClosed(t, tlsReader)
+	_ = tlsConn.Close()
+
+	// Only the accepted connection and the first rejection are logged.
+	connections := database.find("INSERT INTO connections ")
+	if len(connections) != 2 {
+		t.Fatalf("Expected 2 connections to be logged, got %d", len(connections))
+	}
+
+	if count := connections[1][15]; count != int64(1) {
+		t.Errorf("Expected reject count 1, got %v", count)
+	}
+	if reason := connections[1][16]; reason != errTooManyConnections.Error() {
+		t.Errorf("Expected reject reason %q, got %v", errTooManyConnections, reason)
+	}
+
+	// Once the interval has passed the next rejection is logged with the ones in between.
+	server.connections.lock.Lock()
+	server.connections.lastRejectionLogged = time.Now().Add(-rejectionLogInterval)
+	server.connections.lock.Unlock()
+
+	conn, err := net.Dial("tcp", server.listeners[0].listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect, %s", err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	reader := bufio.NewReader(conn)
+	expectReply(t, reader, "421 4.7.0 Too many connections")
+	expectClosed(t, reader)
+	_ = conn.Close()
+
+	connections = database.find("INSERT INTO connections ")
+	if len(connections) != 3 {
+		t.Fatalf("Expected 3 connections to be logged, got %d", len(connections))
+	}
+
+	if count := connections[2][15]; count != int64(4) {
+		t.Errorf("Expected reject count 4, got %v", count)
+	}
+}
+
+func expectClosed(t *testing.T, reader *bufio.Reader) {
+	t.Helper()
+
+	rest, err := io.ReadAll(reader)
+	if err != nil || len(rest) > 0 {
+		t.Fatalf("Expected connection to be closed, got %q, %v", rest, err)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// EnhancedStatusCode is an RFC 3463 enhanced mail system status code, sent after the reply
+// code on every response of EHLO and LHLO sessions, where ENHANCEDSTATUSCODES is advertised.
+type EnhancedStatusCode struct {
+	class   int
+	subject int
+	detail  int
+}
+
+var (
+	EnhancedStatusOK                     = EnhancedStatusCode{2, 0, 0}
+	EnhancedStatusSenderOK               = EnhancedStatusCode{2, 1, 0}
+	EnhancedStatusRecipientOK            = EnhancedStatusCode{2, 1, 5}
+	EnhancedStatusAuthenticated          = EnhancedStatusCode{2, 7, 0}
+	EnhancedStatusServiceUnavailable     = EnhancedStatusCode{4, 3, 2}
+	EnhancedStatusTooManyRecipients      = EnhancedStatusCode{4, 5, 3}
+	EnhancedStatusPolicyDeferred         = EnhancedStatusCode{4, 7, 0}
+	EnhancedStatusRateLimited            = EnhancedStatusCode{4, 7, 1}
+	EnhancedStatusBadRecipientSyntax     = EnhancedStatusCode{5, 1, 3}
+	EnhancedStatusBadSenderSyntax        = EnhancedStatusCode{5, 1, 7}
+	EnhancedStatusMessageTooBig          = EnhancedStatusCode{5, 3, 4}
+	EnhancedStatusBadSequence            = EnhancedStatusCode{5, 5, 1}
+	EnhancedStatusNotImplemented         = EnhancedStatusCode{5, 5, 1}
+	EnhancedStatusUnrecognizedCommand    = EnhancedStatusCode{5, 5, 2}
+	EnhancedStatusSyntaxError            = EnhancedStatusCode{5, 5, 2}
+	EnhancedStatusInvalidArguments       = EnhancedStatusCode{5, 5, 4}
+	EnhancedStatusAuthenticationRequired = EnhancedStatusCode{5, 7, 0}
+	EnhancedStatusSecurityError          = EnhancedStatusCode{5, 7, 0}
+)
+
+func ParseEnhancedStatusCode(value string) (EnhancedStatusCode, error) {
+	parts := strings.Split(value, ".")
+	if len(parts) != 3 {
+		return EnhancedStatusCode{}, fmt.Errorf("invalid enhanced status code %s", value)
+	}
+
+	numbers := make([]int, 0, 3)
+	for _, part := range parts {
+		number, err := strconv.Atoi(part)
+		if err != nil || number < 0 || number > 999 {
+			return EnhancedStatusCode{}, fmt.Errorf("invalid enhanced status code %s", value)
+		}
+		numbers = append(numbers, number)
+	}
+
+	if numbers[0] != 2 && numbers[0] != 4 && numbers[0] != 5 {
+		return EnhancedStatusCode{}, fmt.Errorf("invalid enhanced status code class %d", numbers[0])
+	}
+
+	return EnhancedStatusCode{numbers[0], numbers[1], numbers[2]}, nil
+}
+
+func (n EnhancedStatusCode) IsZero() bool {
+	return n == EnhancedStatusCode{}
+}
+
+func (n EnhancedStatusCode) String() string {
+	return fmt.Sprintf("%d.%d.%d", n.class, n.subject, n.detail)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// traceHeaders builds the Return-Path and Received headers added to the top of each
+// message, the way an MTA would on final delivery.
+func (n *SMTPConnection) traceHeaders(message SMTPMessage, now time.Time) []byte {
+	returnPath := fmt.Sprintf("Return-Path: <%s>\r\n", message.from)
+
+	return append([]byte(returnPath), n.receivedHeader(message, now)...)
+}
+
+// receivedHeader builds an RFC 5321 Received header recording who sent the message, how
+// the session was protected and which connection it arrived on.
+func (n *SMTPConnection) receivedHeader(message SMTPMessage, now time.Time) []byte {
+	literal := addressLiteral(n.record)
+
+	// Unix socket connections have no address literal to name the client with.
+	host := n.record.HeloName
+	if host == "" && n.record.RemoteAddress == "" {
+		host = "localhost"
+	}
+
+	// The comment names the client by its reverse DNS as well, as the HELO name is only
+	// what the client claimed to be.
+	tcpInfo := literal
+	if n.record.RemoteAddress != "" {
+		reverseName := n.record.ReverseName
+		if reverseName == "" {
+			reverseName = "unknown"
+		}
+		tcpInfo = fmt.Sprintf("%s %s", reverseName, literal)
+	}
+
+	from := fmt.Sprintf("from %s (%s)", literal, tcpInfo)
+	if host != "" {
+		from = fmt.Sprintf("from %s (%s)", host, tcpInfo)
+	}
+
+	clauses := []string{
+		from,
+		fmt.Sprintf(
+			"by %s (smtplog) with %s id %s",
+			n.context.Value(smtpContextKey("bannerHost")).(string),
+			n.protocolName(),
+			n.connectionULID,
+		),
+	}
+
+	if n.record.TLS != nil {
+		clauses = append(clauses, fmt.Sprintf("(%s)", n.record.TLS))
+	}
+
+	if len(message.to) == 1 {
+		clauses = append(clauses, fmt.Sprintf("for <%s>", message.to[0].address))
+	}
+
+	return []byte(fmt.Sprintf(
+		"Received: %s;\r\n\t%s\r\n",
+		strings.Join(clauses, "\r\n\t"),
+		now.Format(time.RFC1123Z),
+	))
+}
+
+// protocolName returns the with protocol of the session as registered in RFC 3848, such
+// as ESMTPSA for an authenticated ESMTP session over TLS.
+func (n *SMTPConnection) protocolName() string {
+	protocol := "SMTP"
+	if n.context.Value(smtpContextKey("isLMTP")).(bool) {
+		protocol = "LMTP"
+	} else if n.isExtended {
+		protocol = "ESMTP"
+	}
+
+	if protocol == "SMTP" {
+		return protocol
+	}
+
+	if n.record.TLS != nil {
+		protocol += "S"
+	}
+
+	if n.isAuthenticated {
+		protocol += "A"
+	}
+
+	return protocol
+}
+
+// addressLiteral formats where the connection came from for a trace header, as an
+// address literal for TCP connections or the peer credentials for Unix sockets.
+func addressLiteral(record ConnectionRecord) string {
+	if record.RemoteAddress == "" {
+		return record.String()
+	}
+
+	ip := net.ParseIP(record.RemoteAddress)
+	if ip != nil && ip.To4() == nil {
+		return fmt.Sprintf("[IPv6:%s]", record.RemoteAddress)
+	}
+
+	return fmt.Sprintf("[%s]", record.RemoteAddress)
+}
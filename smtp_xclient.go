@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var xclientAttributes = []string{"NAME", "ADDR", "PORT", "PROTO", "HELO", "LOGIN", "DESTADDR", "DESTPORT"}
+
+var xforwardAttributes = []string{"NAME", "ADDR", "PORT", "PROTO", "HELO", "IDENT", "SOURCE"}
+
+func (n *SMTPConnection) isXClientTrusted() bool {
+	trusted := n.context.Value(smtpContextKey("xclientTrusted")).([]*net.IPNet)
+
+	return isTrustedAddress(n.netConnection.RemoteAddr(), trusted)
+}
+
+func handleXCLIENT(responder *SMTPResponder, connection *SMTPConnection, arguments string) CommandResult {
+	if !connection.isXClientTrusted() {
+		responder.Respond(&SMTPResponse{
+			code:    550,
+			status:  EnhancedStatusSecurityError,
+			message: "Insufficient authorization",
+		})
+		return CommandResultError
+	}
+
+	if len(connection.message.from) > 0 {
+		responder.Respond(&SMTPResponse{
+			code:    503,
+			status:  EnhancedStatusBadSequence,
+			message: "Mail transaction in progress",
+		})
+		return CommandResultError
+	}
+
+	attributes, err := parseForwardedAttributes(arguments, xclientAttributes)
+	if err != nil {
+		responder.Respond(&SMTPResponse{
+			code:    501,
+			status:  EnhancedStatusInvalidArguments,
+			message: fmt.Sprintf("Syntax: XCLIENT attribute=value [attribute=value ...], %s", err),
+		})
+		return CommandResultError
+	}
+
+	applyForwardedAttributes(connection, attributes)
+
+	if login, exists := attributes["LOGIN"]; exists {
+		connection.record.Login = login
+		connection.isAuthenticated = login != ""
+	}
+
+	log.Printf("XCLIENT from %s set session to %s", connection.netConnection.RemoteAddr(), connection.record)
+	connection.updateConnection()
+
+	// XCLIENT starts a new session, so the client is greeted again.
+	connection.authLines = nil
+	connection.isExtended = false
+	connection.isReadingAuth = false
+	connection.message = SMTPMessage{}
+
+	responder.Respond(connection.bannerResponse())
+	return CommandResultOK
+}
+
+func handleXFORWARD(responder *SMTPResponder, connection *SMTPConnection, arguments string) CommandResult {
+	if !connection.isXClientTrusted() {
+		responder.Respond(&SMTPResponse{
+			code:    550,
+			status:  EnhancedStatusSecurityError,
+			message: "Insufficient authorization",
+		})
+		return CommandResultError
+	}
+
+	attributes, err := parseForwardedAttributes(arguments, xforwardAttributes)
+	if err != nil {
+		responder.Respond(&SMTPResponse{
+			code:    501,
+			status:  EnhancedStatusInvalidArguments,
+			message: fmt.Sprintf("Syntax: XFORWARD attribute=value [attribute=value ...], %s", err),
+		})
+		return CommandResultError
+	}
+
+	applyForwardedAttributes(connection, attributes)
+
+	log.Printf("XFORWARD from %s set session to %s", connection.netConnection.RemoteAddr(), connection.record)
+	connection.updateConnection()
+
+	responder.Respond(&SMTPResponse{
+		code:    250,
+		status:  EnhancedStatusOK,
+		message: "OK",
+	})
+	return CommandResultOK
+}
+
+// parseForwardedAttributes parses the xtext encoded attribute=value pairs of an XCLIENT or
+// XFORWARD command. The [UNAVAILABLE] and [TEMPUNAVAIL] values are returned as empty.
+func parseForwardedAttributes(arguments string, allowed []string) (map[string]string, error) {
+	fields := strings.Fields(arguments)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("no attributes")
+	}
+
+	attributes := map[string]string{}
+
+	for _, field := range fields {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid attribute %s", field)
+		}
+
+		name := strings.ToUpper(parts[0])
+		if !containsString(allowed, name) {
+			return nil, fmt.Errorf("unknown attribute %s", name)
+		}
+
+		value, err := decodeXtext(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s value, %w", name, err)
+		}
+
+		if value == "[UNAVAILABLE]" || value == "[TEMPUNAVAIL]" {
+			value = ""
+		}
+
+		// Invalid values are quoted in the error, as it is sent back to the client and they
+		// may contain decoded control characters.
+		switch name {
+		case "ADDR":
+			if value != "" && net.ParseIP(strings.TrimPrefix(strings.ToUpper(value), "IPV6:")) == nil {
+				return nil, fmt.Errorf("invalid ADDR %q", value)
+			}
+		case "HELO":
+			if value != "" && !isHostname(value) && parseAddressLiteral(value) == nil {
+				return nil, fmt.Errorf("invalid HELO %q", value)
+			}
+		case "NAME":
+			if value != "" && !isHostname(value) {
+				return nil, fmt.Errorf("invalid NAME %q", value)
+			}
+		case "PORT":
+			if value != "" {
+				port, err := strconv.Atoi(value)
+				if err != nil || port < 0 || port > 65535 {
+					return nil, fmt.Errorf("invalid PORT %q", value)
+				}
+			}
+		}
+
+		attributes[name] = value
+	}
+
+	return attributes, nil
+}
+
+// applyForwardedAttributes overrides the client recorded for the session, keeping the
+// address of the forwarding server as the proxy address.
+func applyForwardedAttributes(connection *SMTPConnection, attributes map[string]string) {
+	record := &connection.record
+
+	if address, exists := attributes["ADDR"]; exists {
+		if record.ProxyAddress == "" {
+			record.ProxyAddress = record.RemoteAddress
+			record.ProxyPort = record.RemotePort
+		}
+
+		record.RemoteAddress = ""
+		if address != "" {
+			record.RemoteAddress = net.ParseIP(strings.TrimPrefix(strings.ToUpper(address), "IPV6:")).String()
+		}
+		record.RemotePort = 0
+	}
+
+	if port, exists := attributes["PORT"]; exists {
+		record.RemotePort, _ = strconv.Atoi(port)
+	}
+
+	if name, exists := attributes["NAME"]; exists {
+		record.ReverseName = name
+		connection.isReverseNameForwarded = true
+	}
+
+	if helo, exists := attributes["HELO"]; exists {
+		record.HeloName = helo
+		connection.isHeloForwarded = true
+	}
+
+	connection.lookupReverseNames()
+	record.IsHeloVerified = isHeloVerified(record.HeloName, record.RemoteAddress, connection.reverseNames)
+}
+
+func containsString(values []string, search string) bool {
+	for _, value := range values {
+		if value == search {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestParseForwardedAttributes(t *testing.T) {
+	tests := []struct {
+		name      string
+		arguments string
+		valid     bool
+	}{
+		{"hostnames", "NAME=mail.example.com HELO=mail.example.com", true},
+		{"trailing dot", "NAME=mail.example.com. HELO=mail.example.com.", true},
+		{"underscore", "HELO=WIN_CLIENT", true},
+		{"address literal", "HELO=[192.0.2.1]", true},
+		{"ipv6 literal", "HELO=[IPv6:2001:db8::1]", true},
+		{"unavailable", "NAME=[UNAVAILABLE] HELO=[TEMPUNAVAIL]", true},
+		{"helo with CRLF", "HELO=evil+0D+0AX-Injected:+20yes", false},
+		{"name with CRLF", "NAME=evil+0D+0Aexample.com", false},
+		{"helo with space", "HELO=mail+20example.com", false},
+		{"invalid literal", "HELO=[not-an-address]", false},
+		{"name literal", "NAME=[192.0.2.1]", false},
+		{"empty label", "NAME=mail..example.com", false},
+		{"leading hyphen", "NAME=-mail.example.com", false},
+		{"addr with CRLF", "ADDR=192.0.2.1+0D+0A", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseForwardedAttributes(test.arguments, xclientAttributes)
+			if test.valid && err != nil {
+				t.Errorf("Expected %s to be accepted, got %s", test.arguments, err)
+			}
+			if !test.valid && err == nil {
+				t.Errorf("Expected %s to be rejected", test.arguments)
+			}
+			if err != nil && strings.ContainsAny(err.Error(), "\r\n") {
+				t.Errorf("Expected error without line breaks, got %q", err)
+			}
+		})
+	}
+}
+
+func TestXCLIENTRejectsHeaderInjection(t *testing.T) {
+	listener := createTestListener("xclient")
+	listener.TraceHeaders = true
+
+	trusted, err := parseNetworks([]string{"127.0.0.0/8"})
+	if err != nil {
+		t.Fatalf("Failed to parse networks, %s", err)
+	}
+	listener.XClientTrusted = trusted
+
+	server, database := startTestServer(t, context.Background(), listener)
+	conn, reader := dialTestServer(t, server)
+
+	writeTestInput(t, conn, "EHLO client.example.com\r\n")
+	expectReply(t, reader, "250 ")
+
+	writeTestInput(t, conn, "XCLIENT HELO=evil+0D+0AX-Injected:+20yes\r\n")
+	expectReply(t, reader, "501 5.5.4 ")
+
+	writeTestInput(t, conn, "MAIL FROM:<sender@example.com>\r\nRCPT TO:<recipient@example.com>\r\nDATA\r\n")
+	expectReply(t, reader, "250 ")
+	expectReply(t, reader, "250 ")
+	expectReply(t, reader, "354 ")
+
+	writeTestInput(t, conn, "Subject: x\r\n\r\nbody\r\n.\r\nQUIT\r\n")
+	expectReply(t, reader, "250 ")
+	expectReply(t, reader, "221 ")
+
+	mails := database.find("INSERT INTO mail ")
+	if len(mails) != 1 {
+		t.Fatalf("Expected 1 mail to be logged, got %d", len(mails))
+	}
+	if data := string(mails[0][2].([]byte)); strings.Contains(data, "X-Injected") {
+		t.Fatalf("Expected no injected header, got %q", data)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd socket activation.
+const listenFDsStart = 3
+
+type inheritedListener struct {
+	listener net.Listener
+	name     string
+}
+
+// inheritListeners returns the listeners passed to this process with the systemd socket
+// activation protocol, either by systemd itself or by a previous process handing over its
+// listeners. The environment variables are cleared so they are not passed on again.
+func inheritListeners() ([]*inheritedListener, error) {
+	defer func() {
+		_ = os.Unsetenv("LISTEN_PID")
+		_ = os.Unsetenv("LISTEN_FDS")
+		_ = os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	count := os.Getenv("LISTEN_FDS")
+	if count == "" {
+		return nil, nil
+	}
+
+	// A previous smtplog process does not know our pid in advance, so it leaves LISTEN_PID
+	// unset instead.
+	pid := os.Getenv("LISTEN_PID")
+	if pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+
+	fdCount, err := strconv.Atoi(count)
+	if err != nil || fdCount < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %s", count)
+	}
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	listeners := make([]*inheritedListener, 0, fdCount)
+	for i := 0; i < fdCount; i++ {
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+
+		file := os.NewFile(uintptr(listenFDsStart+i), name)
+		listener, err := net.FileListener(file)
+		_ = file.Close()
+		if err != nil {
+			closeInheritedListeners(listeners)
+			return nil, fmt.Errorf("failed to use inherited file descriptor %d, %w", listenFDsStart+i, err)
+		}
+
+		listeners = append(listeners, &inheritedListener{
+			listener: listener,
+			name:     name,
+		})
+	}
+
+	return listeners, nil
+}
+
+// takeInheritedListener removes and returns the inherited listener for the configured
+// listener, matched by name first and by address otherwise.
+func takeInheritedListener(
+	inherited []*inheritedListener,
+	config *ListenerConfiguration,
+) (net.Listener, []*inheritedListener) {
+	for _, isMatch := range []func(*inheritedListener) bool{
+		func(candidate *inheritedListener) bool {
+			return candidate.name == config.Name
+		},
+		func(candidate *inheritedListener) bool {
+			return isListeningOn(candidate.listener, config)
+		},
+	} {
+		for index, candidate := range inherited {
+			if isMatch(candidate) {
+				remaining := append(inherited[:index:index], inherited[index+1:]...)
+				return candidate.listener, remaining
+			}
+		}
+	}
+
+	return nil, inherited
+}
+
+func isListeningOn(listener net.Listener, config *ListenerConfiguration) bool {
+	if listener.Addr().Network() != config.ListenNetwork {
+		return false
+	}
+
+	if config.ListenNetwork == "unix" {
+		return listener.Addr().String() == config.ListenAddress
+	}
+
+	listenerAddr, ok := listener.Addr().(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	configAddr, err := net.ResolveTCPAddr(config.ListenNetwork, config.ListenAddress)
+	if err != nil {
+		return false
+	}
+
+	if configAddr.Port != listenerAddr.Port {
+		return false
+	}
+
+	if configAddr.IP == nil || configAddr.IP.IsUnspecified() {
+		return listenerAddr.IP.IsUnspecified()
+	}
+
+	return configAddr.IP.Equal(listenerAddr.IP)
+}
+
+func closeInheritedListeners(listeners []*inheritedListener) {
+	for _, inherited := range listeners {
+		log.Printf("Closing unused inherited listener %s (%s)", inherited.listener.Addr(), inherited.name)
+
+		err := inherited.listener.Close()
+		if err != nil {
+			log.Printf("Failed to close inherited listener %s, %s", inherited.listener.Addr(), err)
+		}
+	}
+}
+
+// notifySystemd sends a state change such as MAINPID=1234 to the service manager using
+// the systemd notification protocol. It does nothing when not run by systemd.
+func notifySystemd(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+
+	// Sockets in the abstract namespace are given with a leading @.
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
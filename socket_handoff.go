@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// handOffTimeout is how long the new process has to start listening before the hand off
+// is abandoned and this process carries on serving.
+const handOffTimeout = 30 * time.Second
+
+type fileListener interface {
+	File() (*os.File, error)
+	SetDeadline(t time.Time) error
+	SyscallConn() (syscall.RawConn, error)
+}
+
+// HandOff starts a new copy of this process, passing it the open listeners with the
+// systemd socket activation protocol, and waits for it to report that it is accepting
+// connections. Once it returns without error this process should stop accepting and
+// drain its connections.
+//
+// Under systemd the new process is reported as the main process of the service, so it is
+// not stopped when this one exits. This needs Type=notify, with NotifyAccess=main or all.
+func (n *SMTPServer) HandOff() (err error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	for _, listener := range n.listeners {
+		if _, ok := listener.listener.(fileListener); !ok {
+			return fmt.Errorf("listener %s cannot be handed off", listener.name)
+		}
+	}
+
+	// Retrieving a listener's file switches it to blocking mode, which would leave a
+	// pending Accept stuck in the kernel, so accepting is paused first. Connections that
+	// arrive in the meantime wait in the backlog for whichever process resumes.
+	n.pauseAccepting()
+	defer func() {
+		if err != nil {
+			n.resumeAccepting()
+		}
+	}()
+
+	files := make([]*os.File, 0, len(n.listeners))
+	names := make([]string, 0, len(n.listeners))
+
+	defer func() {
+		for _, file := range files {
+			_ = file.Close()
+		}
+	}()
+
+	for _, listener := range n.listeners {
+		file, err := listener.listener.(fileListener).File()
+		if err != nil {
+			return fmt.Errorf("failed to get file for listener %s, %w", listener.name, err)
+		}
+
+		files = append(files, file)
+		names = append(names, listener.name)
+	}
+
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = readyReader.Close()
+	}()
+
+	// The new process binds the metrics address itself, so it is released for it and
+	// taken back if the hand off fails.
+	isServingMetrics := n.metricsServer != nil
+	n.StopMetrics()
+	defer func() {
+		if err != nil && isServingMetrics {
+			metricsErr := n.ServeMetrics(n.metricsAddress)
+			if metricsErr != nil {
+				log.Printf("Failed to resume serving metrics, %s", metricsErr)
+			}
+		}
+	}()
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, readyWriter)
+	cmd.Env = append(
+		os.Environ(),
+		fmt.Sprintf("LISTEN_FDS=%d", len(files)),
+		fmt.Sprintf("LISTEN_FDNAMES=%s", strings.Join(names, ":")),
+		fmt.Sprintf("SMTPLOG_READY_FD=%d", listenFDsStart+len(files)),
+	)
+
+	err = cmd.Start()
+	_ = readyWriter.Close()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Started process %d, waiting for it to accept connections", cmd.Process.Pid)
+
+	ready := make(chan error, 1)
+	go func() {
+		buffer := make([]byte, 1)
+		_, err := readyReader.Read(buffer)
+		ready <- err
+	}()
+
+	select {
+	case err = <-ready:
+		if err != nil {
+			_ = cmd.Process.Kill()
+			_, _ = cmd.Process.Wait()
+			return fmt.Errorf("process %d exited before accepting connections", cmd.Process.Pid)
+		}
+	case <-time.After(handOffTimeout):
+		_ = cmd.Process.Kill()
+		_, _ = cmd.Process.Wait()
+		return fmt.Errorf("process %d did not accept connections in time", cmd.Process.Pid)
+	}
+
+	// The socket files now belong to the new process and must survive our listeners closing.
+	for _, listener := range n.listeners {
+		if unixListener, ok := listener.listener.(*net.UnixListener); ok {
+			unixListener.SetUnlinkOnClose(false)
+		}
+	}
+
+	log.Printf("Handed listeners off to process %d", cmd.Process.Pid)
+
+	notifyErr := notifyHandedOff(cmd.Process.Pid)
+	if notifyErr != nil {
+		log.Printf("Failed to notify systemd of process %d, %s", cmd.Process.Pid, notifyErr)
+	}
+
+	// The new process outlives this one, so it is not waited on.
+	_ = cmd.Process.Release()
+
+	return nil
+}
+
+// notifyHandedOff reports the process the listeners were handed to as the main process of
+// the service. It is reported as ready at the same time, as systemd only accepts
+// notifications from the main process and so would ignore it reporting itself.
+func notifyHandedOff(pid int) error {
+	return notifySystemd(fmt.Sprintf("MAINPID=%d\nREADY=1", pid))
+}
+
+// pauseAccepting expires the deadline on every listener so their Accept calls return
+// without waiting, and holds the accept loops until resumeAccepting or Stop is called.
+func (n *SMTPServer) pauseAccepting() {
+	n.pauseLock.Lock()
+	n.resumeChannel = make(chan interface{})
+	n.pauseLock.Unlock()
+
+	for _, listener := range n.listeners {
+		err := listener.listener.(fileListener).SetDeadline(time.Now())
+		if err != nil {
+			log.Printf("Failed to pause listener %s, %s", listener.name, err)
+		}
+	}
+}
+
+func (n *SMTPServer) resumeAccepting() {
+	for _, listener := range n.listeners {
+		withFile := listener.listener.(fileListener)
+
+		var controlErr error
+		rawConn, err := withFile.SyscallConn()
+		if err == nil {
+			err = rawConn.Control(func(fd uintptr) {
+				controlErr = setNonblocking(fd)
+			})
+		}
+		if err == nil {
+			err = controlErr
+		}
+		if err != nil {
+			log.Printf("Failed to restore listener %s, %s", listener.name, err)
+		}
+
+		err = withFile.SetDeadline(time.Time{})
+		if err != nil {
+			log.Printf("Failed to resume listener %s, %s", listener.name, err)
+		}
+	}
+
+	n.pauseLock.Lock()
+	close(n.resumeChannel)
+	n.resumeChannel = nil
+	n.pauseLock.Unlock()
+}
+
+// pausedChannel returns the channel that is closed when accepting resumes, or nil if
+// accepting is not paused.
+func (n *SMTPServer) pausedChannel() chan interface{} {
+	n.pauseLock.Lock()
+	defer n.pauseLock.Unlock()
+
+	return n.resumeChannel
+}
+
+// NotifyReady tells the process that handed off its listeners, or systemd when this
+// process was started directly, that we are now accepting connections.
+func NotifyReady() {
+	fd := os.Getenv("SMTPLOG_READY_FD")
+	if fd == "" {
+		err := notifySystemd("READY=1")
+		if err != nil {
+			log.Printf("Failed to notify systemd, %s", err)
+		}
+		return
+	}
+	_ = os.Unsetenv("SMTPLOG_READY_FD")
+
+	fdNumber, err := strconv.Atoi(fd)
+	if err != nil {
+		log.Printf("Invalid SMTPLOG_READY_FD %s", fd)
+		return
+	}
+
+	file := os.NewFile(uintptr(fdNumber), "ready")
+
+	_, err = file.Write([]byte{1})
+	if err != nil {
+		log.Printf("Failed to notify parent process, %s", err)
+	}
+
+	_ = file.Close()
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// handOffSignals are the signals that hand the listeners off to a new process.
+var handOffSignals = []os.Signal{syscall.SIGUSR2}
+
+// setNonblocking undoes the switch to blocking mode made when a listener's file is
+// retrieved, so the runtime poller can manage it again.
+func setNonblocking(fd uintptr) error {
+	return syscall.SetNonblock(int(fd), true)
+}
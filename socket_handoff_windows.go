@@ -0,0 +1,10 @@
+package main
+
+import "os"
+
+// handOffSignals is empty as listeners cannot be handed off on Windows.
+var handOffSignals []os.Signal
+
+func setNonblocking(_ uintptr) error {
+	return nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// certificateCheckInterval is how often the certificate files are checked for changes.
+// Checks happen during handshakes so an idle server does not touch the filesystem.
+const certificateCheckInterval = 10 * time.Second
+
+// CertificateStore serves certificates loaded from disk, reloading each pair when its
+// files change and choosing between them by the server name the client asks for.
+type CertificateStore struct {
+	lastCheck time.Time
+	lock      sync.RWMutex
+	sources   []*certificateSource
+}
+
+type certificateSource struct {
+	certFile     string
+	certificate  *tls.Certificate
+	certModTime  time.Time
+	keyFile      string
+	keyModTime   time.Time
+	loadFailures int
+}
+
+func LoadCertificateStore(files []CertificateConfiguration) (*CertificateStore, error) {
+	store := &CertificateStore{
+		lastCheck: time.Now(),
+	}
+
+	for _, file := range files {
+		source := &certificateSource{
+			certFile: file.CertFile,
+			keyFile:  file.KeyFile,
+		}
+
+		err := checkCertificateFiles(file.CertFile, file.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		err = source.load()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load certificate %s, %w", file.CertFile, err)
+		}
+
+		store.sources = append(store.sources, source)
+	}
+
+	return store, nil
+}
+
+// GetCertificate is used as the tls.Config callback. It returns the first certificate
+// valid for the requested server name, falling back to the first certificate configured.
+func (n *CertificateStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	n.reloadChanged()
+
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
+	if len(n.sources) == 0 {
+		return nil, fmt.Errorf("no certificates configured")
+	}
+
+	if hello.ServerName != "" {
+		for _, source := range n.sources {
+			if hello.SupportsCertificate(source.certificate) == nil {
+				return source.certificate, nil
+			}
+		}
+	}
+
+	return n.sources[0].certificate, nil
+}
+
+func (n *CertificateStore) String() string {
+	files := make([]string, 0, len(n.sources))
+	for _, source := range n.sources {
+		files = append(files, source.certFile)
+	}
+	return strings.Join(files, ", ")
+}
+
+// reloadChanged reloads every certificate whose files have changed since they were last
+// loaded. A pair that fails to load, such as when only one of the files has been replaced
+// so far, keeps serving the previous certificate and is retried on the next check.
+func (n *CertificateStore) reloadChanged() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if time.Since(n.lastCheck) < certificateCheckInterval {
+		return
+	}
+	n.lastCheck = time.Now()
+
+	for _, source := range n.sources {
+		if !source.hasChanged() {
+			continue
+		}
+
+		err := source.load()
+		if err != nil {
+			source.loadFailures++
+			if source.loadFailures == 1 {
+				log.Printf("Failed to reload certificate %s, %s", source.certFile, err)
+			}
+			continue
+		}
+
+		log.Printf("Reloaded certificate %s", source.certFile)
+	}
+}
+
+func (n *certificateSource) hasChanged() bool {
+	certInfo, err := os.Stat(n.certFile)
+	if err != nil {
+		return false
+	}
+
+	keyInfo, err := os.Stat(n.keyFile)
+	if err != nil {
+		return false
+	}
+
+	return !certInfo.ModTime().Equal(n.certModTime) || !keyInfo.ModTime().Equal(n.keyModTime)
+}
+
+func (n *certificateSource) load() error {
+	certInfo, err := os.Stat(n.certFile)
+	if err != nil {
+		return err
+	}
+
+	keyInfo, err := os.Stat(n.keyFile)
+	if err != nil {
+		return err
+	}
+
+	certificate, err := tls.LoadX509KeyPair(n.certFile, n.keyFile)
+	if err != nil {
+		return err
+	}
+
+	// The leaf is needed to match server names and is not parsed by LoadX509KeyPair.
+	certificate.Leaf, err = x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return err
+	}
+
+	n.certificate = &certificate
+	n.certModTime = certInfo.ModTime()
+	n.keyModTime = keyInfo.ModTime()
+	n.loadFailures = 0
+
+	return nil
+}
+
+func checkCertificateFiles(certFile string, keyFile string) error {
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(keyFile)
+	if certErr != nil && keyErr != nil {
+		if os.IsNotExist(certErr) && os.IsNotExist(keyErr) {
+			return fmt.Errorf("certificate and key file not found")
+		}
+	}
+	if certErr != nil {
+		if os.IsNotExist(certErr) {
+			return fmt.Errorf("certificate file not found")
+		}
+		return certErr
+	}
+	if keyErr != nil {
+		if os.IsNotExist(keyErr) {
+			return fmt.Errorf("key file not found")
+		}
+		return keyErr
+	}
+
+	return nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// TLSPolicy holds the handshake settings for a listener as written in the configuration
+// file, so changes can be reported on reload.
+type TLSPolicy struct {
+	Ciphers    []string
+	ClientAuth string
+	ClientCA   string
+	Curves     []string
+	MaxVersion string
+	MinVersion string
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"x25519": tls.X25519,
+	"p-256":  tls.CurveP256,
+	"p-384":  tls.CurveP384,
+	"p-521":  tls.CurveP521,
+}
+
+var tlsClientAuthTypes = map[string]tls.ClientAuthType{
+	"none":     tls.NoClientCert,
+	"request":  tls.RequestClientCert,
+	"optional": tls.VerifyClientCertIfGiven,
+	"required": tls.RequireAndVerifyClientCert,
+}
+
+func loadTLSPolicy(defaults ConfigurationFile, listener ListenerConfigurationFile) TLSPolicy {
+	policy := TLSPolicy{
+		Ciphers:    listener.TLSCiphers,
+		ClientAuth: firstString(listener.TLSClientAuth, defaults.TLSClientAuth, "none"),
+		ClientCA:   firstString(listener.TLSClientCA, defaults.TLSClientCA),
+		Curves:     listener.TLSCurves,
+		MaxVersion: firstString(listener.TLSMaxVersion, defaults.TLSMaxVersion),
+		MinVersion: firstString(listener.TLSMinVersion, defaults.TLSMinVersion, "1.2"),
+	}
+
+	if len(policy.Ciphers) == 0 {
+		policy.Ciphers = defaults.TLSCiphers
+	}
+	if len(policy.Curves) == 0 {
+		policy.Curves = defaults.TLSCurves
+	}
+
+	return policy
+}
+
+// apply sets the policy on a TLS configuration. Cipher suites only restrict TLS 1.2 and
+// earlier as TLS 1.3 suites cannot be configured.
+func (n TLSPolicy) apply(config *tls.Config) error {
+	minVersion, ok := tlsVersions[n.MinVersion]
+	if !ok {
+		return fmt.Errorf("unknown tls_min_version %s, expected 1.0, 1.1, 1.2 or 1.3", n.MinVersion)
+	}
+	config.MinVersion = minVersion
+
+	if n.MaxVersion != "" {
+		maxVersion, ok := tlsVersions[n.MaxVersion]
+		if !ok {
+			return fmt.Errorf("unknown tls_max_version %s, expected 1.0, 1.1, 1.2 or 1.3", n.MaxVersion)
+		}
+		if maxVersion < minVersion {
+			return fmt.Errorf("tls_max_version %s is lower than tls_min_version %s", n.MaxVersion, n.MinVersion)
+		}
+		config.MaxVersion = maxVersion
+	}
+
+	for _, name := range n.Ciphers {
+		id, err := findCipherSuite(name)
+		if err != nil {
+			return err
+		}
+		config.CipherSuites = append(config.CipherSuites, id)
+	}
+
+	for _, name := range n.Curves {
+		curve, ok := tlsCurves[strings.ToLower(name)]
+		if !ok {
+			return fmt.Errorf("unknown tls curve %s, expected X25519, P-256, P-384 or P-521", name)
+		}
+		config.CurvePreferences = append(config.CurvePreferences, curve)
+	}
+
+	clientAuth, ok := tlsClientAuthTypes[strings.ToLower(n.ClientAuth)]
+	if !ok {
+		return fmt.Errorf("unknown tls_client_auth %s, expected none, request, optional or required", n.ClientAuth)
+	}
+	config.ClientAuth = clientAuth
+
+	if n.ClientCA != "" {
+		pool, err := loadCertificatePool(n.ClientCA)
+		if err != nil {
+			return err
+		}
+		config.ClientCAs = pool
+	} else if clientAuth == tls.VerifyClientCertIfGiven || clientAuth == tls.RequireAndVerifyClientCert {
+		return fmt.Errorf("tls_client_auth %s requires tls_client_ca", n.ClientAuth)
+	}
+
+	return nil
+}
+
+// findCipherSuite looks up a cipher suite by its standard name, such as
+// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. Insecure suites are allowed so older senders
+// can be tested.
+func findCipherSuite(name string) (uint16, error) {
+	suites := append(tls.CipherSuites(), tls.InsecureCipherSuites()...)
+
+	for _, suite := range suites {
+		if !strings.EqualFold(suite.Name, name) {
+			continue
+		}
+
+		if len(suite.SupportedVersions) == 1 && suite.SupportedVersions[0] == tls.VersionTLS13 {
+			return 0, fmt.Errorf("tls cipher %s cannot be configured, TLS 1.3 suites are always enabled", name)
+		}
+
+		return suite.ID, nil
+	}
+
+	return 0, fmt.Errorf("unknown tls cipher %s", name)
+}
+
+func loadCertificatePool(file string) (*x509.CertPool, error) {
+	contents, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tls_client_ca, %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(contents) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+
+	return pool, nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// selfSignedValidity is how long generated certificates are valid for, and
+// selfSignedRenewBefore is how close to expiry a cached certificate is replaced.
+const (
+	selfSignedValidity    = 365 * 24 * time.Hour
+	selfSignedRenewBefore = 30 * 24 * time.Hour
+)
+
+// GenerateCertificate creates a self-signed certificate valid for the given host names and
+// IP addresses, returning the PEM encoded certificate and private key.
+func GenerateCertificate(names []string, validity time.Duration) ([]byte, []byte, error) {
+	if len(names) == 0 {
+		return nil, nil, fmt.Errorf("no names to generate a certificate for")
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{CommonName: names[0], Organization: []string{"smtplog-server"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, name)
+		}
+	}
+
+	certificate, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes})
+
+	return certPEM, keyPEM, nil
+}
+
+// WriteCertificate writes a PEM encoded certificate and key, keeping the key private.
+func WriteCertificate(certFile string, keyFile string, certPEM []byte, keyPEM []byte) error {
+	err := os.WriteFile(keyFile, keyPEM, 0o600)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(certFile, certPEM, 0o644) //nolint:gosec
+}
+
+// ensureSelfSignedCertificate returns the cached self-signed certificate for the given
+// names, generating a new one when there is none, it is close to expiring or it does not
+// cover every name.
+func ensureSelfSignedCertificate(directory string, names []string) (CertificateConfiguration, error) {
+	if directory == "" {
+		cacheDirectory, err := os.UserCacheDir()
+		if err != nil {
+			return CertificateConfiguration{}, fmt.Errorf("failed to find cache directory, %w", err)
+		}
+		directory = filepath.Join(cacheDirectory, "smtplog-server")
+	}
+
+	err := os.MkdirAll(directory, 0o700)
+	if err != nil {
+		return CertificateConfiguration{}, err
+	}
+
+	file := CertificateConfiguration{
+		CertFile: filepath.Join(directory, "self-signed.crt"),
+		KeyFile:  filepath.Join(directory, "self-signed.key"),
+	}
+
+	if isCachedCertificateUsable(file, names) {
+		return file, nil
+	}
+
+	certPEM, keyPEM, err := GenerateCertificate(names, selfSignedValidity)
+	if err != nil {
+		return CertificateConfiguration{}, err
+	}
+
+	err = WriteCertificate(file.CertFile, file.KeyFile, certPEM, keyPEM)
+	if err != nil {
+		return CertificateConfiguration{}, err
+	}
+
+	log.Printf("Generated self-signed certificate for %s in %s", strings.Join(names, ", "), directory)
+
+	return file, nil
+}
+
+func isCachedCertificateUsable(file CertificateConfiguration, names []string) bool {
+	certificate, err := tls.LoadX509KeyPair(file.CertFile, file.KeyFile)
+	if err != nil {
+		return false
+	}
+
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return false
+	}
+
+	if time.Until(leaf.NotAfter) < selfSignedRenewBefore {
+		return false
+	}
+
+	for _, name := range names {
+		if leaf.VerifyHostname(name) != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// selfSignedNames returns the names a generated certificate should cover: every banner
+// host followed by the configured subject alternative names.
+func selfSignedNames(configuration ConfigurationFile) []string {
+	var names []string
+
+	add := func(name string) {
+		if name != "" && !containsString(names, name) {
+			names = append(names, name)
+		}
+	}
+
+	add(configuration.BannerHost)
+	for _, listener := range configuration.Listeners {
+		add(listener.BannerHost)
+	}
+	for _, name := range configuration.TLSNames {
+		add(name)
+	}
+
+	if len(names) == 0 {
+		add("localhost")
+	}
+
+	return names
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// TLSDetails describes the TLS session negotiated on a connection.
+type TLSDetails struct {
+	ALPN              string
+	CipherSuite       string
+	ClientFingerprint string
+	ClientSubject     string
+	ServerName        string
+	Version           string
+}
+
+func createTLSDetails(state tls.ConnectionState) *TLSDetails {
+	details := &TLSDetails{
+		ALPN:        state.NegotiatedProtocol,
+		CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+		ServerName:  state.ServerName,
+		Version:     formatTLSVersion(state.Version),
+	}
+
+	if len(state.PeerCertificates) > 0 {
+		certificate := state.PeerCertificates[0]
+		fingerprint := sha256.Sum256(certificate.Raw)
+
+		details.ClientFingerprint = hex.EncodeToString(fingerprint[:])
+		details.ClientSubject = certificate.Subject.String()
+	}
+
+	return details
+}
+
+// String formats the session as the comment used in Received headers.
+func (n *TLSDetails) String() string {
+	parts := []string{
+		fmt.Sprintf("version=%s", n.Version),
+		fmt.Sprintf("cipher=%s", n.CipherSuite),
+	}
+
+	if n.ServerName != "" {
+		parts = append(parts, fmt.Sprintf("sni=%s", n.ServerName))
+	}
+
+	if n.ALPN != "" {
+		parts = append(parts, fmt.Sprintf("alpn=%s", n.ALPN))
+	}
+
+	if n.ClientSubject != "" {
+		parts = append(parts, fmt.Sprintf("client=%q", n.ClientSubject))
+	}
+
+	return strings.Join(parts, " ")
+}
+
+func formatTLSVersion(version uint16) string {
+	for name, value := range tlsVersions {
+		if value == version {
+			return fmt.Sprintf("TLSv%s", name)
+		}
+	}
+	return fmt.Sprintf("0x%04x", version)
+}